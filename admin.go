@@ -0,0 +1,367 @@
+package bus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type (
+	// Admin is the client of nsqd and nsqlookupd HTTP API.
+	Admin struct {
+		address    string
+		lookup     []string
+		scheme     string
+		authSecret string
+		client     *http.Client
+	}
+
+	// AdminError is returned when nsqd HTTP API responds with a non-2xx status code.
+	AdminError struct {
+		Method     string
+		URL        string
+		StatusCode int
+		Body       string
+	}
+
+	// Node carries a nsqd node registered in nsqlookupd.
+	Node struct {
+		RemoteAddress    string   `json:"remote_address"`
+		Hostname         string   `json:"hostname"`
+		BroadcastAddress string   `json:"broadcast_address"`
+		TCPPort          int      `json:"tcp_port"`
+		HTTPPort         int      `json:"http_port"`
+		Version          string   `json:"version"`
+		Topics           []string `json:"topics"`
+	}
+
+	// Stats carries the response of nsqd /stats endpoint.
+	Stats struct {
+		Version   string       `json:"version"`
+		Health    string       `json:"health"`
+		StartTime int64        `json:"start_time"`
+		Topics    []TopicStats `json:"topics"`
+	}
+
+	// TopicStats carries the stats of a topic and its channels.
+	TopicStats struct {
+		TopicName    string         `json:"topic_name"`
+		Channels     []ChannelStats `json:"channels"`
+		Depth        int64          `json:"depth"`
+		BackendDepth int64          `json:"backend_depth"`
+		MessageCount uint64         `json:"message_count"`
+		Paused       bool           `json:"paused"`
+	}
+
+	// ChannelStats carries the stats of a channel.
+	ChannelStats struct {
+		ChannelName   string `json:"channel_name"`
+		Depth         int64  `json:"depth"`
+		BackendDepth  int64  `json:"backend_depth"`
+		InFlightCount int    `json:"in_flight_count"`
+		DeferredCount int    `json:"deferred_count"`
+		MessageCount  uint64 `json:"message_count"`
+		RequeueCount  uint64 `json:"requeue_count"`
+		TimeoutCount  uint64 `json:"timeout_count"`
+		ClientCount   int    `json:"client_count"`
+		Paused        bool   `json:"paused"`
+	}
+)
+
+// NewAdmin returns a new Admin configured with the variables from the config parameter.
+func NewAdmin(ac AdminConfig) *Admin {
+	address := ac.Address
+	if len(address) == 0 {
+		address = "localhost:4151"
+	}
+
+	lookup := ac.Lookup
+	if len(lookup) == 0 {
+		lookup = []string{"localhost:4161"}
+	}
+
+	timeout := ac.Timeout
+	if timeout == 0 {
+		timeout = time.Second * 5
+	}
+
+	scheme := "http"
+	transport := http.DefaultTransport
+	if ac.TLSConfig != nil {
+		scheme = "https"
+		transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: ac.TLSConfig,
+		}
+	}
+
+	return &Admin{
+		address:    address,
+		lookup:     lookup,
+		scheme:     scheme,
+		authSecret: ac.AuthSecret,
+		client:     &http.Client{Transport: transport, Timeout: timeout},
+	}
+}
+
+// CreateTopic creates a topic.
+func (a *Admin) CreateTopic(topic string) error {
+	return a.topic("create", topic)
+}
+
+// DeleteTopic deletes a topic and all its channels.
+func (a *Admin) DeleteTopic(topic string) error {
+	return a.topic("delete", topic)
+}
+
+// EmptyTopic empties all the queued messages of a topic.
+func (a *Admin) EmptyTopic(topic string) error {
+	return a.topic("empty", topic)
+}
+
+// PauseTopic pauses message flow to all channels of a topic.
+func (a *Admin) PauseTopic(topic string) error {
+	return a.topic("pause", topic)
+}
+
+// UnpauseTopic resumes message flow to the channels of a paused topic.
+func (a *Admin) UnpauseTopic(topic string) error {
+	return a.topic("unpause", topic)
+}
+
+// CreateChannel creates a channel for a topic.
+func (a *Admin) CreateChannel(topic, channel string) error {
+	return a.channel("create", topic, channel)
+}
+
+// DeleteChannel deletes a channel of a topic.
+func (a *Admin) DeleteChannel(topic, channel string) error {
+	return a.channel("delete", topic, channel)
+}
+
+// EmptyChannel empties all the queued messages of a channel.
+func (a *Admin) EmptyChannel(topic, channel string) error {
+	return a.channel("empty", topic, channel)
+}
+
+// PauseChannel pauses message flow to the consumers of a channel.
+func (a *Admin) PauseChannel(topic, channel string) error {
+	return a.channel("pause", topic, channel)
+}
+
+// UnpauseChannel resumes message flow to the consumers of a paused channel.
+func (a *Admin) UnpauseChannel(topic, channel string) error {
+	return a.channel("unpause", topic, channel)
+}
+
+// Stats returns the stats of all topics and channels of nsqd.
+func (a *Admin) Stats() (*Stats, error) {
+	stats := &Stats{}
+	if err := a.do(http.MethodGet, "/stats", url.Values{"format": {"json"}}, stats); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// Ping returns an error if nsqd is not healthy.
+func (a *Admin) Ping() error {
+	return a.do(http.MethodGet, "/ping", nil, nil)
+}
+
+// WithAddress returns a copy of the Admin sending nsqd requests to address.
+func (a *Admin) WithAddress(address string) *Admin {
+	c := *a
+	c.address = address
+	return &c
+}
+
+// Nodes returns the nsqd nodes registered in all nsqlookupd, returns an
+// error if none of nsqlookupd could be queried.
+func (a *Admin) Nodes() ([]Node, error) {
+	var (
+		nodes []Node
+		seen  = make(map[string]bool)
+		err   error
+	)
+
+	queried := false
+	for _, lookup := range a.lookup {
+		var res struct {
+			Producers []Node `json:"producers"`
+		}
+
+		if err = a.doURL(http.MethodGet, a.url(lookup, "/nodes", nil), &res); err != nil {
+			continue
+		}
+		queried = true
+
+		for _, node := range res.Producers {
+			if addr := node.HTTPAddress(); !seen[addr] {
+				seen[addr] = true
+				nodes = append(nodes, node)
+			}
+		}
+	}
+
+	if !queried {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+// Topics returns the topics registered in all nsqlookupd, returns an
+// error if none of nsqlookupd could be queried.
+func (a *Admin) Topics() ([]string, error) {
+	var (
+		topics []string
+		seen   = make(map[string]bool)
+		err    error
+	)
+
+	queried := false
+	for _, lookup := range a.lookup {
+		var res struct {
+			Topics []string `json:"topics"`
+		}
+
+		if err = a.doURL(http.MethodGet, a.url(lookup, "/topics", nil), &res); err != nil {
+			continue
+		}
+		queried = true
+
+		for _, topic := range res.Topics {
+			if !seen[topic] {
+				seen[topic] = true
+				topics = append(topics, topic)
+			}
+		}
+	}
+
+	if !queried {
+		return nil, err
+	}
+
+	return topics, nil
+}
+
+// HTTPAddress returns the address of nsqd HTTP API.
+func (n Node) HTTPAddress() string {
+	return net.JoinHostPort(n.BroadcastAddress, strconv.Itoa(n.HTTPPort))
+}
+
+func (a *Admin) topic(action, topic string) error {
+	if len(topic) == 0 {
+		return ErrTopicRequired
+	}
+
+	return a.do(http.MethodPost, "/topic/"+action, url.Values{"topic": {topic}}, nil)
+}
+
+func (a *Admin) channel(action, topic, channel string) error {
+	if len(topic) == 0 {
+		return ErrTopicRequired
+	}
+
+	if len(channel) == 0 {
+		return ErrChannelRequired
+	}
+
+	return a.do(http.MethodPost, "/channel/"+action, url.Values{"topic": {topic}, "channel": {channel}}, nil)
+}
+
+func (a *Admin) do(method, path string, query url.Values, v interface{}) error {
+	return a.doURL(method, a.url(a.address, path, query), v)
+}
+
+func (a *Admin) doURL(method, uri string, v interface{}) error {
+	req, err := http.NewRequest(method, uri, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/vnd.nsq; version=1.0")
+	if len(a.authSecret) != 0 {
+		req.Header.Set("Authorization", "Bearer "+a.authSecret)
+	}
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<24))
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &AdminError{
+			Method:     method,
+			URL:        uri,
+			StatusCode: res.StatusCode,
+			Body:       string(body),
+		}
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return decodeAdminResponse(body, v)
+}
+
+func (a *Admin) url(address, path string, query url.Values) string {
+	u := url.URL{
+		Scheme:   a.scheme,
+		Host:     address,
+		Path:     path,
+		RawQuery: query.Encode(),
+	}
+
+	return u.String()
+}
+
+// Error returns the request and the response status code and body.
+func (e *AdminError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.URL, e.StatusCode, e.Body)
+}
+
+// decodeAdminResponse deserializes body into v, unwrapping the legacy
+// {"status_code", "status_txt", "data"} envelope of older nsqd versions.
+func decodeAdminResponse(body []byte, v interface{}) error {
+	var legacy struct {
+		StatusCode int             `json:"status_code"`
+		Data       json.RawMessage `json:"data"`
+	}
+
+	if err := json.Unmarshal(body, &legacy); err == nil && legacy.StatusCode != 0 && len(legacy.Data) != 0 {
+		body = legacy.Data
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// httpAddress returns the nsqd HTTP address assuming it listens
+// on the port following the TCP port of address.
+func httpAddress(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(p+1)), nil
+}
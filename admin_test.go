@@ -0,0 +1,310 @@
+package bus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAdmin(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		scenario string
+		function func(*testing.T)
+	}{
+		{
+			"topic and channel actions",
+			testAdminActions,
+		},
+		{
+			"stats",
+			testAdminStats,
+		},
+		{
+			"ping",
+			testAdminPing,
+		},
+		{
+			"non-2xx response",
+			testAdminError,
+		},
+		{
+			"validation",
+			testAdminValidation,
+		},
+		{
+			"lookup nodes",
+			testAdminNodes,
+		},
+		{
+			"lookup topics",
+			testAdminTopics,
+		},
+		{
+			"http address",
+			testHTTPAddress,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			test.function(t)
+		})
+	}
+}
+
+func testAdminActions(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("unexpected method %s", r.Method)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer foo" {
+			t.Errorf("unexpected authorization %s", auth)
+		}
+		requests = append(requests, r.URL.Path+"?"+r.URL.RawQuery)
+	}))
+	defer server.Close()
+
+	admin := NewAdmin(AdminConfig{
+		Address:    serverAddress(server),
+		AuthSecret: "foo",
+	})
+
+	actions := []func() error{
+		func() error { return admin.CreateTopic("t") },
+		func() error { return admin.DeleteTopic("t") },
+		func() error { return admin.EmptyTopic("t") },
+		func() error { return admin.PauseTopic("t") },
+		func() error { return admin.UnpauseTopic("t") },
+		func() error { return admin.CreateChannel("t", "c") },
+		func() error { return admin.DeleteChannel("t", "c") },
+		func() error { return admin.EmptyChannel("t", "c") },
+		func() error { return admin.PauseChannel("t", "c") },
+		func() error { return admin.UnpauseChannel("t", "c") },
+	}
+
+	for _, action := range actions {
+		if err := action(); err != nil {
+			t.Fatalf("expected admin action to succeed %v", err)
+		}
+	}
+
+	expected := []string{
+		"/topic/create?topic=t",
+		"/topic/delete?topic=t",
+		"/topic/empty?topic=t",
+		"/topic/pause?topic=t",
+		"/topic/unpause?topic=t",
+		"/channel/create?channel=c&topic=t",
+		"/channel/delete?channel=c&topic=t",
+		"/channel/empty?channel=c&topic=t",
+		"/channel/pause?channel=c&topic=t",
+		"/channel/unpause?channel=c&topic=t",
+	}
+
+	if fmt.Sprint(requests) != fmt.Sprint(expected) {
+		t.Errorf("unexpected requests %v", requests)
+	}
+}
+
+func testAdminStats(t *testing.T) {
+	cases := []struct {
+		msg  string
+		body string
+	}{
+		{
+			"current api",
+			`{"version":"1.0.0","health":"OK","topics":[{"topic_name":"t","depth":3,"channels":[{"channel_name":"c","depth":2,"in_flight_count":1,"requeue_count":4,"timeout_count":5}]}]}`,
+		},
+		{
+			"legacy api",
+			`{"status_code":200,"status_txt":"OK","data":{"version":"0.3.8","health":"OK","topics":[{"topic_name":"t","depth":3,"channels":[{"channel_name":"c","depth":2,"in_flight_count":1,"requeue_count":4,"timeout_count":5}]}]}}`,
+		},
+	}
+
+	for _, c := range cases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/stats" || r.URL.Query().Get("format") != "json" {
+				t.Errorf("%s: unexpected request %s", c.msg, r.URL)
+			}
+			fmt.Fprint(w, c.body)
+		}))
+
+		stats, err := NewAdmin(AdminConfig{Address: serverAddress(server)}).Stats()
+		server.Close()
+		if err != nil {
+			t.Fatalf("%s: expected to get stats %v", c.msg, err)
+		}
+
+		if len(stats.Topics) != 1 || stats.Topics[0].TopicName != "t" || stats.Topics[0].Depth != 3 {
+			t.Fatalf("%s: unexpected topics %+v", c.msg, stats.Topics)
+		}
+
+		ch := stats.Topics[0].Channels[0]
+		if ch.ChannelName != "c" || ch.Depth != 2 || ch.InFlightCount != 1 || ch.RequeueCount != 4 || ch.TimeoutCount != 5 {
+			t.Errorf("%s: unexpected channel %+v", c.msg, ch)
+		}
+	}
+}
+
+func testAdminPing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ping" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		fmt.Fprint(w, "OK")
+	}))
+	defer server.Close()
+
+	if err := NewAdmin(AdminConfig{Address: serverAddress(server)}).Ping(); err != nil {
+		t.Fatalf("expected to ping nsqd %v", err)
+	}
+}
+
+func testAdminError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message":"TOPIC_NOT_FOUND"}`)
+	}))
+	defer server.Close()
+
+	err := NewAdmin(AdminConfig{Address: serverAddress(server)}).DeleteTopic("t")
+	aerr, ok := err.(*AdminError)
+	if !ok {
+		t.Fatalf("expected admin error, got %v", err)
+	}
+
+	if aerr.StatusCode != http.StatusNotFound || aerr.Method != http.MethodPost || !strings.Contains(aerr.Body, "TOPIC_NOT_FOUND") {
+		t.Errorf("unexpected admin error %v", aerr)
+	}
+}
+
+func testAdminValidation(t *testing.T) {
+	admin := NewAdmin(AdminConfig{})
+
+	if err := admin.CreateTopic(""); err != ErrTopicRequired {
+		t.Errorf("unexpected error value %v", err)
+	}
+
+	if err := admin.CreateChannel("t", ""); err != ErrChannelRequired {
+		t.Errorf("unexpected error value %v", err)
+	}
+}
+
+func testAdminNodes(t *testing.T) {
+	lookupd := newLookupdMock(t, "10.0.0.1:4151", "10.0.0.2:4151")
+	defer lookupd.Close()
+	other := newLookupdMock(t, "10.0.0.2:4151")
+	defer other.Close()
+
+	admin := NewAdmin(AdminConfig{Lookup: []string{"127.0.0.1:1", serverAddress(lookupd), serverAddress(other)}})
+	nodes, err := admin.Nodes()
+	if err != nil {
+		t.Fatalf("expected to lookup nodes %v", err)
+	}
+
+	if len(nodes) != 2 || nodes[0].HTTPAddress() != "10.0.0.1:4151" || nodes[1].HTTPAddress() != "10.0.0.2:4151" {
+		t.Errorf("unexpected nodes %+v", nodes)
+	}
+
+	if _, err := NewAdmin(AdminConfig{Lookup: []string{"127.0.0.1:1"}}).Nodes(); err == nil {
+		t.Error("expected error when no nsqlookupd is reachable")
+	}
+}
+
+func testAdminTopics(t *testing.T) {
+	lookupd := newTopicsLookupdMock([]string{"orders.a", "users"})
+	defer lookupd.Close()
+	other := newTopicsLookupdMock([]string{"users", "orders.b"})
+	defer other.Close()
+
+	admin := NewAdmin(AdminConfig{Lookup: []string{"127.0.0.1:1", serverAddress(lookupd), serverAddress(other)}})
+	topics, err := admin.Topics()
+	if err != nil {
+		t.Fatalf("expected to lookup topics %v", err)
+	}
+
+	if fmt.Sprint(topics) != "[orders.a users orders.b]" {
+		t.Errorf("unexpected topics %v", topics)
+	}
+
+	if _, err := NewAdmin(AdminConfig{Lookup: []string{"127.0.0.1:1"}}).Topics(); err == nil {
+		t.Error("expected error when no nsqlookupd is reachable")
+	}
+}
+
+func testHTTPAddress(t *testing.T) {
+	cases := []struct {
+		address  string
+		expected string
+		wantErr  bool
+	}{
+		{"localhost:4150", "localhost:4151", false},
+		{"[::1]:4250", "[::1]:4251", false},
+		{"localhost", "", true},
+	}
+
+	for _, c := range cases {
+		addr, err := httpAddress(c.address)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: unexpected error value %v", c.address, err)
+		}
+
+		if addr != c.expected {
+			t.Errorf("%s: unexpected http address %s", c.address, addr)
+		}
+	}
+}
+
+// newLookupdMock returns a nsqlookupd stand-in registering nsqd nodes at the given HTTP addresses.
+func newLookupdMock(t *testing.T, addresses ...string) *httptest.Server {
+	var producers []string
+	for _, address := range addresses {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			t.Fatalf("expected to split address %v", err)
+		}
+		producers = append(producers, fmt.Sprintf(`{"broadcast_address":%q,"tcp_port":4150,"http_port":%s}`, host, port))
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/nodes" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"producers":[%s]}`, strings.Join(producers, ","))
+	}))
+}
+
+// newTopicsLookupdMock returns a nsqlookupd stand-in registering the topics returned by topics.
+func newTopicsLookupdMock(topics ...[]string) *httptest.Server {
+	var mu sync.Mutex
+	calls := 0
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/topics" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		mu.Lock()
+		current := topics[calls]
+		if calls < len(topics)-1 {
+			calls++
+		}
+		mu.Unlock()
+
+		body, _ := json.Marshal(map[string][]string{"topics": current})
+		w.Write(body)
+	}))
+}
+
+func serverAddress(server *httptest.Server) string {
+	return strings.TrimPrefix(server.URL, "http://")
+}
@@ -0,0 +1,262 @@
+package bus
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultBatchTimeout is how long a batch is accumulated when BatchTimeout is not configured.
+const defaultBatchTimeout = time.Second
+
+// BatchHandlerFunc is the handler function to handle a batch of messages, it returns
+// either nil when all messages were handled or the error of each message at its index,
+// messages whose error is not nil are requeued.
+type BatchHandlerFunc func(ms []*Message) []error
+
+// batchQueue accumulates the received messages until BatchSize messages are pending
+// or BatchTimeout elapsed since the first one, and handles them with BatchHandlerFunc.
+type batchQueue struct {
+	h       *handler
+	size    int
+	timeout time.Duration
+
+	mu      sync.Mutex
+	pending []*nsq.Message
+	timer   *time.Timer
+
+	// runMu serializes the batches, a batch filled while another is handled waits for it.
+	runMu sync.Mutex
+}
+
+func newBatchQueue(h *handler) *batchQueue {
+	maxInFlight := h.lc.MaxInFlight
+	if maxInFlight <= 0 {
+		maxInFlight = 1
+	}
+
+	size := h.lc.BatchSize
+	if size <= 0 || size > maxInFlight {
+		size = maxInFlight
+	}
+
+	timeout := h.lc.BatchTimeout
+	if timeout <= 0 {
+		timeout = defaultBatchTimeout
+	}
+
+	q := &batchQueue{h: h, size: size, timeout: timeout}
+
+	go func() {
+		<-h.ctx.Done()
+		q.flush()
+	}()
+
+	return q
+}
+
+// add appends the message to the pending batch, the message is responded once
+// the batch is handled. The batch is handled by the caller once it is full.
+func (q *batchQueue) add(message *nsq.Message) {
+	q.mu.Lock()
+	if q.h.ctx.Err() != nil {
+		q.mu.Unlock()
+		q.h.requeue(message, 0)
+		return
+	}
+
+	q.pending = append(q.pending, message)
+	if len(q.pending) < q.size {
+		if q.timer == nil {
+			q.timer = time.AfterFunc(q.timeout, func() {
+				q.mu.Lock()
+				q.timer = nil
+				batch := q.take()
+				q.mu.Unlock()
+
+				q.process(batch)
+			})
+		}
+		q.mu.Unlock()
+		return
+	}
+
+	batch := q.take()
+	q.mu.Unlock()
+
+	q.process(batch)
+}
+
+// take removes and returns the pending batch, q.mu must be held.
+func (q *batchQueue) take() []*nsq.Message {
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+
+	batch := q.pending
+	q.pending = nil
+	return batch
+}
+
+// process handles the batch, then finishes the messages handled without error
+// and requeues the others.
+func (q *batchQueue) process(batch []*nsq.Message) {
+	if len(batch) == 0 {
+		return
+	}
+
+	q.runMu.Lock()
+	defer q.runMu.Unlock()
+
+	if q.h.ctx.Err() != nil {
+		for _, message := range batch {
+			q.h.requeue(message, 0)
+		}
+		return
+	}
+
+	for i, err := range q.h.handleBatch(batch) {
+		if err != nil {
+			q.h.requeue(batch[i], -1)
+			continue
+		}
+
+		q.h.finish(batch[i])
+	}
+}
+
+// flush requeues the pending messages once the listener is stopped.
+func (q *batchQueue) flush() {
+	q.mu.Lock()
+	batch := q.take()
+	q.mu.Unlock()
+
+	for _, message := range batch {
+		q.h.requeue(message, 0)
+	}
+}
+
+// wait blocks until the batch being handled, if any, is responded.
+func (q *batchQueue) wait() {
+	q.runMu.Lock()
+	defer q.runMu.Unlock()
+}
+
+// handleBatch decodes the messages and calls BatchHandlerFunc with the ones which are
+// not duplicates, it returns the error of every message of batch at its index.
+func (h *handler) handleBatch(batch []*nsq.Message) []error {
+	errs := make([]error, len(batch))
+	spans := make([]trace.Span, len(batch))
+	defer func() {
+		for i, span := range spans {
+			if span != nil {
+				endSpan(span, errs[i])
+			}
+		}
+	}()
+
+	var (
+		ms      []*Message
+		indexes []int
+	)
+	for i, message := range batch {
+		m := &Message{Message: message, Topic: h.lc.Topic}
+		if err := json.Unmarshal(message.Body, m); err != nil {
+			h.lc.Metrics.observeHandled(h.lc.Topic, h.lc.Channel, message.Attempts, 0, resultInvalid)
+			h.logger.Error("failed to decode message", h.fields(message, "error", err)...)
+			errs[i] = err
+			continue
+		}
+
+		ctx, span := startConsumerSpan(h.ctx, h.tracer, h.lc.Topic, h.lc.Channel, m)
+		spans[i] = span
+
+		dup, err := h.processed(ctx, m)
+		if err != nil || dup {
+			errs[i] = err
+			continue
+		}
+
+		ms = append(ms, m)
+		indexes = append(indexes, i)
+	}
+
+	if len(ms) == 0 {
+		return errs
+	}
+
+	if err := h.limiter.wait(h.ctx, len(ms)); err != nil {
+		for _, i := range indexes {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	var stops []func()
+	for _, m := range ms {
+		stops = append(stops, h.touch(m.Message))
+	}
+
+	start := time.Now()
+	res := h.callBatch(ms)
+	for _, stop := range stops {
+		stop()
+	}
+	elapsed := time.Since(start)
+
+	for j, m := range ms {
+		i := indexes[j]
+		errs[i] = res[j]
+		h.lc.Metrics.observeHandled(h.lc.Topic, h.lc.Channel, m.Attempts, elapsed, resultOf(res[j]))
+		if res[j] == nil {
+			h.markProcessed(h.ctx, m)
+		}
+	}
+
+	return errs
+}
+
+// callBatch runs BatchHandlerFunc and returns the error of every message of ms,
+// a panic or a result of another length than ms fails all messages.
+func (h *handler) callBatch(ms []*Message) (errs []error) {
+	defer func() {
+		if r := recover(); r != nil {
+			perr := &PanicError{Value: r, Stack: debug.Stack()}
+			h.logger.Error("batch handler panicked", "topic", h.lc.Topic, "channel", h.lc.Channel, "size", len(ms), "panic", r, "stack", string(perr.Stack))
+			if h.lc.OnPanic != nil {
+				for _, m := range ms {
+					h.lc.OnPanic(m, perr)
+				}
+			}
+			errs = batchErrors(len(ms), perr)
+		}
+	}()
+
+	errs = h.lc.BatchHandlerFunc(ms)
+	if errs == nil {
+		return make([]error, len(ms))
+	}
+
+	if len(errs) != len(ms) {
+		err := fmt.Errorf("batch handler returned %d errors for %d messages", len(errs), len(ms))
+		h.logger.Error("invalid batch handler result", "topic", h.lc.Topic, "channel", h.lc.Channel, "error", err)
+		return batchErrors(len(ms), err)
+	}
+
+	return errs
+}
+
+func batchErrors(n int, err error) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+
+	return errs
+}
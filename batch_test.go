@@ -0,0 +1,258 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+func TestBatch(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		scenario string
+		function func(*testing.T)
+	}{
+		{
+			"full batch bounded by max in flight",
+			testBatchFull,
+		},
+		{
+			"batch timeout",
+			testBatchTimeout,
+		},
+		{
+			"batch handler results",
+			testBatchResults,
+		},
+		{
+			"invalid message",
+			testBatchInvalidMessage,
+		},
+		{
+			"stop requeues pending messages",
+			testBatchStop,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			test.function(t)
+		})
+	}
+}
+
+func testBatchFull(t *testing.T) {
+	r := &batchRecorder{}
+	h := newHandler(context.Background(), ListenerConfig{
+		Topic:            "orders",
+		Channel:          "billing",
+		MaxInFlight:      3,
+		BatchSize:        10,
+		BatchTimeout:     time.Hour,
+		BatchHandlerFunc: r.handle,
+	})
+
+	delegate := deliverBatch(t, h, `"ok"`, `"fail"`, `"ok"`)
+	if batches := r.sizes(); fmt.Sprint(batches) != "[3]" {
+		t.Fatalf("expected one batch of MaxInFlight messages, got %v", batches)
+	}
+
+	if delegate.finished != 2 || delegate.requeued != 1 {
+		t.Errorf("expected 2 finished and 1 requeued messages, got %d and %d", delegate.finished, delegate.requeued)
+	}
+
+	if topic := r.batches[0][0].Topic; topic != "orders" {
+		t.Errorf("expected message topic to be orders, got %q", topic)
+	}
+}
+
+func testBatchTimeout(t *testing.T) {
+	r := &batchRecorder{}
+	h := newHandler(context.Background(), ListenerConfig{
+		MaxInFlight:      5,
+		BatchTimeout:     time.Millisecond * 20,
+		BatchHandlerFunc: r.handle,
+	})
+
+	delegate := deliverBatch(t, h, `"ok"`, `"ok"`)
+	if batches := r.sizes(); len(batches) != 0 {
+		t.Fatalf("expected batch to wait for BatchTimeout, got %v", batches)
+	}
+
+	waitBatches(t, r, 1)
+	if batches := r.sizes(); fmt.Sprint(batches) != "[2]" {
+		t.Errorf("expected one batch of 2 messages, got %v", batches)
+	}
+
+	h.stop()
+	delegate.mu.Lock()
+	defer delegate.mu.Unlock()
+	if delegate.finished != 2 {
+		t.Errorf("expected 2 finished messages, got %d", delegate.finished)
+	}
+}
+
+func testBatchResults(t *testing.T) {
+	cases := []struct {
+		msg      string
+		fn       BatchHandlerFunc
+		finished int
+		requeued int
+	}{
+		{
+			"nil errors",
+			func(ms []*Message) []error { return nil },
+			2, 0,
+		},
+		{
+			"errors of another length",
+			func(ms []*Message) []error { return []error{nil} },
+			0, 2,
+		},
+		{
+			"panic",
+			func(ms []*Message) []error { panic("boom") },
+			0, 2,
+		},
+	}
+
+	for _, c := range cases {
+		var panics int
+		h := newHandler(context.Background(), ListenerConfig{
+			MaxInFlight:      2,
+			BatchHandlerFunc: c.fn,
+			Logger:           &loggerMock{},
+			OnPanic: func(m *Message, err *PanicError) {
+				panics++
+			},
+		})
+
+		delegate := deliverBatch(t, h, `"ok"`, `"ok"`)
+		if delegate.finished != c.finished || delegate.requeued != c.requeued {
+			t.Errorf("%s: expected %d finished and %d requeued messages, got %d and %d",
+				c.msg, c.finished, c.requeued, delegate.finished, delegate.requeued)
+		}
+
+		if c.msg == "panic" && panics != 2 {
+			t.Errorf("expected OnPanic to be called for every message, got %d", panics)
+		}
+	}
+}
+
+func testBatchInvalidMessage(t *testing.T) {
+	r := &batchRecorder{}
+	h := newHandler(context.Background(), ListenerConfig{
+		MaxInFlight:      2,
+		BatchHandlerFunc: r.handle,
+		Logger:           &loggerMock{},
+	})
+
+	delegate := &messageDelegateMock{}
+	invalid := nsq.NewMessage(nsq.MessageID{}, []byte(`{`))
+	invalid.Delegate = delegate
+	h.HandleMessage(invalid)
+
+	valid := newNSQMessage(t, NewMessage([]byte(`"ok"`), ""))
+	valid.Delegate = delegate
+	h.HandleMessage(valid)
+
+	if batches := r.sizes(); fmt.Sprint(batches) != "[1]" {
+		t.Errorf("expected the valid message to be handled, got %v", batches)
+	}
+
+	if delegate.finished != 1 || delegate.requeued != 1 {
+		t.Errorf("expected 1 finished and 1 requeued messages, got %d and %d", delegate.finished, delegate.requeued)
+	}
+}
+
+func testBatchStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &batchRecorder{}
+	h := newHandler(ctx, ListenerConfig{
+		MaxInFlight:      5,
+		BatchTimeout:     time.Hour,
+		BatchHandlerFunc: r.handle,
+	})
+
+	delegate := deliverBatch(t, h, `"ok"`, `"ok"`)
+	cancel()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		delegate.mu.Lock()
+		requeued := delegate.requeued
+		delegate.mu.Unlock()
+		if requeued == 2 {
+			if batches := r.sizes(); len(batches) != 0 {
+				t.Errorf("expected pending messages not to be handled, got %v", batches)
+			}
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Error("expected pending messages to be requeued")
+}
+
+// deliverBatch delivers messages with the given payloads sharing a single delegate.
+func deliverBatch(t *testing.T, h *handler, payloads ...string) *messageDelegateMock {
+	delegate := &messageDelegateMock{}
+	for _, payload := range payloads {
+		message := newNSQMessage(t, NewMessage([]byte(payload), ""))
+		message.Delegate = delegate
+		if err := h.HandleMessage(message); err != nil {
+			t.Fatalf("expected message to be added to the batch %v", err)
+		}
+	}
+
+	return delegate
+}
+
+// batchRecorder records the batches it handles, failing the messages whose payload is "fail".
+type batchRecorder struct {
+	mu      sync.Mutex
+	batches [][]*Message
+}
+
+func (r *batchRecorder) handle(ms []*Message) []error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches = append(r.batches, ms)
+
+	errs := make([]error, len(ms))
+	for i, m := range ms {
+		var payload string
+		if err := m.DecodePayload(&payload); err != nil || payload == "fail" {
+			errs[i] = errors.New("failed")
+		}
+	}
+
+	return errs
+}
+
+func (r *batchRecorder) sizes() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var sizes []int
+	for _, batch := range r.batches {
+		sizes = append(sizes, len(batch))
+	}
+	return sizes
+}
+
+func waitBatches(t *testing.T, r *batchRecorder, n int) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if len(r.sizes()) >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d handled batches", n)
+}
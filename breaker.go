@@ -0,0 +1,130 @@
+package bus
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/sony/gobreaker"
+)
+
+// BreakerCounts holds the numbers of requests and their results seen by a circuit
+// breaker, counts are cleared on every state change and every Breaker.Interval
+// in the closed state.
+type BreakerCounts struct {
+	Requests             uint32
+	TotalSuccesses       uint32
+	TotalFailures        uint32
+	ConsecutiveSuccesses uint32
+	ConsecutiveFailures  uint32
+}
+
+// validationErrors are the nsqd error codes returned when the published message
+// itself is rejected, nsqd is healthy and retrying the same message fails again.
+var validationErrors = []string{"E_INVALID", "E_BAD_BODY", "E_BAD_TOPIC", "E_BAD_MESSAGE"}
+
+// IsValidationError reports whether err is nsqd rejecting the published message,
+// e.g. a message exceeding --max-msg-size or an invalid topic name.
+func IsValidationError(err error) bool {
+	perr, ok := err.(nsq.ErrProtocol)
+	if !ok {
+		return false
+	}
+
+	for _, code := range validationErrors {
+		if strings.HasPrefix(perr.Reason, code) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// execute runs publish within the circuit breaker of topic, every attempt of the
+// retry policy is a request of the breaker.
+func (e *Emitter) execute(ctx context.Context, topic string, publish func() error) error {
+	return e.retry.do(ctx, func() error {
+		_, err := e.breaker(topic).Execute(func() (interface{}, error) {
+			return nil, publish()
+		})
+
+		return err
+	}, func(attempt int, err error, wait time.Duration) {
+		e.logger.Debug("retrying publish", "topic", topic, "attempt", attempt, "backoff", wait, "error", err)
+	})
+}
+
+// ephemeralTopics stands for the reply topics in circuit breakers and metric labels,
+// reply topics are unique per request and would otherwise add a breaker and metric series each.
+const ephemeralTopics = "*.ephemeral"
+
+// topicKey returns the name topic is tracked by in circuit breakers and metric labels.
+func topicKey(topic string) string {
+	if strings.HasSuffix(topic, ".ephemeral") || strings.HasSuffix(topic, "#ephemeral") {
+		return ephemeralTopics
+	}
+
+	return topic
+}
+
+// breaker returns the circuit breaker of topic, creating it on first use so a
+// failing topic does not trip publishing to the other topics.
+func (e *Emitter) breaker(topic string) *gobreaker.CircuitBreaker {
+	topic = topicKey(topic)
+
+	e.breakersMu.Lock()
+	defer e.breakersMu.Unlock()
+
+	cb, ok := e.breakers[topic]
+	if !ok {
+		cb = gobreaker.NewCircuitBreaker(newBreakerSettings(topic, e.breakerConfig, e.metrics, e.logger))
+		e.breakers[topic] = cb
+	}
+
+	return cb
+}
+
+func newBreakerSettings(topic string, c Breaker, metrics *Metrics, logger Logger) gobreaker.Settings {
+	return gobreaker.Settings{
+		Name:     "nsq-emitter-circuit-breaker:" + topic,
+		Interval: c.Interval,
+		Timeout:  c.Timeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return c.readyToTrip(BreakerCounts(counts))
+		},
+		IsSuccessful: func(err error) bool {
+			return err == nil || !c.isFailure(err)
+		},
+		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
+			metrics.observeBreakerState(name, from.String(), to.String(), float64(to))
+			logger.Warn("circuit breaker state changed", "breaker", name, "topic", topic, "from", from.String(), "to", to.String())
+			if c.OnStateChange != nil {
+				c.OnStateChange(name, from.String(), to.String())
+			}
+		},
+	}
+}
+
+// isFailure reports whether err counts toward tripping the breaker.
+func (c Breaker) isFailure(err error) bool {
+	if c.IsFailure != nil {
+		return c.IsFailure(err)
+	}
+
+	return !IsValidationError(err)
+}
+
+// readyToTrip reports whether the breaker trips after a failure with counts.
+func (c Breaker) readyToTrip(counts BreakerCounts) bool {
+	if c.ReadyToTrip != nil {
+		return c.ReadyToTrip(counts)
+	}
+
+	if c.FailureRatio > 0 {
+		return counts.Requests >= c.MinRequests &&
+			float64(counts.TotalFailures)/float64(counts.Requests) >= c.FailureRatio
+	}
+
+	return counts.ConsecutiveFailures > c.Threshold
+}
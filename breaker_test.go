@@ -0,0 +1,154 @@
+package bus
+
+import (
+	"errors"
+	"testing"
+
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/sony/gobreaker"
+)
+
+func TestBreaker(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		scenario string
+		function func(*testing.T)
+	}{
+		{
+			"per topic breakers",
+			testBreakerPerTopic,
+		},
+		{
+			"ready to trip policy",
+			testBreakerReadyToTrip,
+		},
+		{
+			"validation errors",
+			testBreakerValidationErrors,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			test.function(t)
+		})
+	}
+}
+
+func testBreakerPerTopic(t *testing.T) {
+	emitter, err := NewEmitter(EmitterConfig{Address: "127.0.0.1:1", LogLevel: LogError})
+	if err != nil {
+		t.Fatalf("expected to initialize emitter %v", err)
+	}
+	defer emitter.Stop()
+
+	if err := emitter.Emit("orders", "event"); err == nil || err == gobreaker.ErrOpenState {
+		t.Fatalf("expected emit to fail without nsqd %v", err)
+	}
+
+	if err := emitter.Emit("orders", "event"); err != gobreaker.ErrOpenState {
+		t.Errorf("expected orders breaker to be open %v", err)
+	}
+
+	if state := emitter.breaker("users").State(); state != gobreaker.StateClosed {
+		t.Errorf("expected users breaker to be closed %v", state)
+	}
+
+	if emitter.breaker("orders") != emitter.breaker("orders") {
+		t.Error("expected breakers to be created once per topic")
+	}
+
+	for i := 0; i < 10; i++ {
+		topic, err := emitter.genReplyQueue()
+		if err != nil {
+			t.Fatalf("expected to generate reply topic %v", err)
+		}
+		emitter.breaker(topic)
+	}
+
+	if emitter.breaker("a.ephemeral") != emitter.breaker("b#ephemeral") || len(emitter.breakers) != 3 {
+		t.Errorf("expected reply topics to share a single breaker, got %d breakers", len(emitter.breakers))
+	}
+}
+
+func testBreakerReadyToTrip(t *testing.T) {
+	cases := []struct {
+		msg      string
+		breaker  Breaker
+		counts   BreakerCounts
+		expected bool
+	}{
+		{
+			"consecutive failures below threshold",
+			Breaker{Threshold: 2},
+			BreakerCounts{Requests: 2, TotalFailures: 2, ConsecutiveFailures: 2},
+			false,
+		},
+		{
+			"consecutive failures above threshold",
+			Breaker{Threshold: 2},
+			BreakerCounts{Requests: 3, TotalFailures: 3, ConsecutiveFailures: 3},
+			true,
+		},
+		{
+			"failure ratio below min requests",
+			Breaker{FailureRatio: 0.5, MinRequests: 10},
+			BreakerCounts{Requests: 4, TotalFailures: 4, ConsecutiveFailures: 4},
+			false,
+		},
+		{
+			"failure ratio below ratio",
+			Breaker{FailureRatio: 0.5, MinRequests: 10},
+			BreakerCounts{Requests: 10, TotalSuccesses: 6, TotalFailures: 4, ConsecutiveFailures: 1},
+			false,
+		},
+		{
+			"failure ratio reached",
+			Breaker{FailureRatio: 0.5, MinRequests: 10},
+			BreakerCounts{Requests: 10, TotalSuccesses: 5, TotalFailures: 5, ConsecutiveFailures: 1},
+			true,
+		},
+		{
+			"custom policy",
+			Breaker{Threshold: 100, ReadyToTrip: func(counts BreakerCounts) bool { return counts.TotalFailures > 1 }},
+			BreakerCounts{Requests: 2, TotalFailures: 2, ConsecutiveFailures: 2},
+			true,
+		},
+	}
+
+	for _, c := range cases {
+		if tripped := c.breaker.readyToTrip(c.counts); tripped != c.expected {
+			t.Errorf("%s: unexpected ready to trip %v", c.msg, tripped)
+		}
+	}
+}
+
+func testBreakerValidationErrors(t *testing.T) {
+	tooBig := nsq.ErrProtocol{Reason: "E_BAD_MESSAGE PUB message too big 2048 > 1024"}
+	if !IsValidationError(tooBig) || IsValidationError(nsq.ErrProtocol{Reason: "E_PUB_FAILED PUB failed"}) || IsValidationError(errors.New("E_BAD_TOPIC")) {
+		t.Error("unexpected validation error classification")
+	}
+
+	cb := gobreaker.NewCircuitBreaker(newBreakerSettings("orders", Breaker{}, nil, newLogger(nil, LogError)))
+	for i := 0; i < 5; i++ {
+		cb.Execute(func() (interface{}, error) {
+			return nil, tooBig
+		})
+	}
+
+	if cb.State() != gobreaker.StateClosed {
+		t.Errorf("expected validation errors not to trip the breaker %v", cb.State())
+	}
+
+	custom := gobreaker.NewCircuitBreaker(newBreakerSettings("orders", Breaker{
+		IsFailure: func(err error) bool { return true },
+	}, nil, newLogger(nil, LogError)))
+	custom.Execute(func() (interface{}, error) {
+		return nil, tooBig
+	})
+
+	if custom.State() != gobreaker.StateOpen {
+		t.Errorf("expected IsFailure to classify errors %v", custom.State())
+	}
+}
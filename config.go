@@ -3,9 +3,11 @@ package bus
 import (
 	"crypto/tls"
 	"net"
+	"regexp"
 	"time"
 
 	nsq "github.com/nsqio/go-nsq"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // EmitterConfig carries the different variables to tune a newly started emitter,
@@ -43,6 +45,43 @@ type EmitterConfig struct {
 	AuthSecret              string
 	// Breaker circuit breaker configuration
 	Breaker
+	// Admin is used to create the internal reply topics. If Admin is nil, nsqd HTTP API
+	// is queried at HTTPAddress.
+	Admin *Admin
+	// HTTPAddress is the nsqd HTTP address used when Admin is nil, it is queried with the
+	// TLSConfig and AuthSecret of the producer, e.g. the nsqd --https-address. If HTTPAddress
+	// is empty, the plain HTTP API at the port following the TCP port of Address is used.
+	HTTPAddress string
+	// Topics is the list of topics created on nsqd when the emitter is created.
+	Topics []string
+	// RequestTimeout is how long the reply listener of Request waits for the last reply
+	// before it is stopped. Default value is 1 minute.
+	RequestTimeout time.Duration
+	// Lookup is the list of nsqlookupd HTTP addresses the reply listeners of requests
+	// discover nsqd from, defaults to localhost:4161.
+	Lookup []string
+	// Metrics when set, collects the emitter publishes and circuit breaker metrics.
+	Metrics *Metrics
+	// TracerProvider is used to start producer spans, defaults to the global TracerProvider.
+	TracerProvider trace.TracerProvider
+	// Logger logs the emitter and nsq producer events, defaults to the standard logger.
+	Logger Logger
+	// LogLevel is the minimum level of the logged events, defaults to LogInfo.
+	LogLevel LogLevel
+	// Spool when Spool.Dir is set, messages which Emit and EmitAsync fail to publish,
+	// e.g. nsqd is unavailable or the circuit breaker is open, are appended to an on-disk
+	// spool and republished in order by a background drainer.
+	Spool SpoolConfig
+	// IdempotencyCacheTTL is how long the idempotency keys of the emitted messages are kept,
+	// emits of a kept key are dropped. Default value is 1 minute, a negative value disables the cache.
+	IdempotencyCacheTTL time.Duration
+	// IdempotencyCacheSize is the maximum number of kept idempotency keys. Default value is 10000.
+	IdempotencyCacheSize int
+	// Retry is the retry policy of the failed publishes, publishes are not retried by default.
+	Retry RetryPolicy
+	// Partitions when greater than 0, messages emitted WithPartitionKey are published to one of
+	// Partitions sub-topics picked by the hash of the key, see PartitionTopic.
+	Partitions int
 }
 
 // ListenerConfig carries the different variables to tune a newly started consumer,
@@ -82,9 +121,179 @@ type ListenerConfig struct {
 	MaxInFlight             int
 	MsgTimeout              time.Duration
 	AuthSecret              string
+	// OnPanic is called whenever HandlerFunc panics, the message is then requeued
+	// following the retry policy given by MaxAttempts, DefaultRequeueDelay and BackoffStrategy.
+	OnPanic func(m *Message, err *PanicError)
+	// DeadLetterTopic when set, messages which exceeded MaxAttempts are published to it
+	// instead of being discarded.
+	DeadLetterTopic string
+	// AutoTouch when enabled, the message is touched at half of MsgTimeout while
+	// HandlerFunc is running, preventing nsqd from redelivering it mid-processing.
+	AutoTouch bool
+	// MaxProcessingTime limits for how long the message is kept alive by AutoTouch,
+	// if MaxProcessingTime is 0, the message is touched until HandlerFunc returns.
+	MaxProcessingTime time.Duration
+	// HandlerTimeout is the deadline of the context passed to HandlerFunc, the message
+	// is requeued once it is exceeded while Listener.Stop still waits for HandlerFunc to
+	// return. If HandlerTimeout is 0, MaxProcessingTime is used when AutoTouch is enabled,
+	// otherwise MsgTimeout.
+	HandlerTimeout time.Duration
+	// Emitter is used to publish replies and dead letters. If Emitter is nil, one emitter
+	// per nsqd is lazily created from the listener connection settings and stopped with the listener.
+	Emitter *Emitter
+	// RequeueOnErrorReply when enabled, requests whose HandlerFunc returned an error are
+	// requeued after the error reply is sent, otherwise they are finished. Requests
+	// interrupted by Stop are requeued without a reply.
+	RequeueOnErrorReply bool
+	// EnsureTopology when enabled, the topic and channel are created on every nsqd
+	// known to nsqlookupd before connecting.
+	EnsureTopology bool
+	// Admin is used by EnsureTopology, PauseChannel and to discover the topics matching
+	// TopicPattern or TopicRegexp. If Admin is nil, nsqlookupd is queried at Lookup.
+	Admin *Admin
+	// PauseChannel when enabled, Listener.Pause and Resume also pause and unpause the channel
+	// of every topic in every nsqd known to nsqlookupd, which affects all consumers of the channel.
+	PauseChannel bool
+	// Topics lists topics consumed on Channel in addition to Topic, each topic is consumed
+	// by its own nsq consumer calling HandlerFunc.
+	Topics []string
+	// TopicPattern when set, the topics registered in nsqlookupd whose name matches the glob
+	// pattern, as of path.Match, are consumed on Channel, e.g. orders.*.
+	TopicPattern string
+	// TopicRegexp when set, the topics registered in nsqlookupd whose name matches it are
+	// consumed on Channel.
+	TopicRegexp *regexp.Regexp
+	// TopicPollInterval is how often nsqlookupd is queried for new topics matching TopicPattern
+	// or TopicRegexp. Default value is LookupdPollInterval, or 1 minute if not set.
+	TopicPollInterval time.Duration
+	// BatchHandlerFunc when set, replaces HandlerFunc and handles the messages in batches of
+	// up to BatchSize messages, each message is finished or requeued according to its error.
+	// Replies, Ordered and HandlerTimeout do not apply to batches.
+	BatchHandlerFunc BatchHandlerFunc
+	// BatchSize is the maximum number of messages of a batch, it is bounded by MaxInFlight
+	// which must be raised accordingly. Default value is MaxInFlight.
+	BatchSize int
+	// BatchTimeout is how long a batch is accumulated from its first message before it is
+	// handled with fewer than BatchSize messages. Default value is 1 second.
+	BatchTimeout time.Duration
+	// RateLimit when Rate is set, HandlerFunc, or BatchHandlerFunc for each message of a batch,
+	// waits for a token of the bucket shared by all topics of the listener. While messages are
+	// throttled, MaxInFlight is lowered to what Rate handles within half of MsgTimeout so the
+	// waiting messages do not time out, and restored once the bucket is full again.
+	RateLimit RateLimit
+	// Metrics when set, collects the handled messages metrics.
+	Metrics *Metrics
+	// TracerProvider is used to start consumer spans and the spans of replies,
+	// defaults to the global TracerProvider.
+	TracerProvider trace.TracerProvider
+	// Logger logs the listener and nsq consumer events, defaults to the standard logger.
+	Logger Logger
+	// LogLevel is the minimum level of the logged events, defaults to LogInfo.
+	LogLevel LogLevel
+	// Deduplicator when set, messages whose IdempotencyKey, or UUID when not set, was already
+	// processed are finished without calling HandlerFunc, keys are recorded once HandlerFunc
+	// returns no error.
+	Deduplicator Deduplicator
+	// Ordered when enabled, messages emitted WithPartitionKey are handled serially per key,
+	// in the order of their PartitionSeq, the other messages are handled as usual. Messages
+	// arriving ahead of a missing one are buffered, MaxInFlight must leave room for them.
+	Ordered bool
+	// MaxBufferedPerKey is the maximum number of messages buffered per key while waiting for
+	// a missing one, beyond it the missing message is skipped. Default value is 100.
+	MaxBufferedPerKey int
+	// MaxGapWait is how long buffered messages wait for a missing one before it is skipped.
+	// Default value is half of MsgTimeout.
+	MaxGapWait time.Duration
 }
 
-// Breaker carries the configuration for circuit breaker
+// AdminConfig carries the different variables to tune a newly created nsqd HTTP API client.
+type AdminConfig struct {
+	// Address is the nsqd HTTP address, defaults to localhost:4151.
+	Address string
+	// Lookup is the list of nsqlookupd HTTP addresses, defaults to localhost:4161.
+	Lookup []string
+	// TLSConfig when set, nsqd HTTPS API is used.
+	TLSConfig *tls.Config
+	// AuthSecret when set, is sent as a bearer token in the Authorization header.
+	AuthSecret string
+	// Timeout of the HTTP requests, defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+// MonitorConfig carries the different variables to tune a newly created queue depth monitor.
+type MonitorConfig struct {
+	// Lookup is the list of nsqlookupd HTTP addresses, defaults to localhost:4161.
+	Lookup []string
+	// Admin is used to query nsqlookupd and nsqd. If Admin is nil, nsqlookupd is queried at Lookup.
+	Admin *Admin
+	// Interval between polls, defaults to 30 seconds.
+	Interval time.Duration
+	// Thresholds are checked against every channel after each poll.
+	Thresholds []Threshold
+	// OnError is called when a poll fails, errors are logged if OnError is nil.
+	OnError func(error)
+	// Logger logs the failed polls when OnError is nil, defaults to the standard logger.
+	Logger Logger
+}
+
+// Threshold carries the limits of a channel, OnExceeded is called after each
+// poll while any of the non-zero limits is exceeded.
+type Threshold struct {
+	// Topic and Channel restrict the threshold to a topic or channel, empty values match any.
+	Topic        string
+	Channel      string
+	MaxDepth     int64
+	MaxInFlight  int64
+	MaxDepthRate float64
+	OnExceeded   func(ChannelDepth)
+}
+
+// SpoolConfig carries the configuration of the emitter on-disk spool.
+type SpoolConfig struct {
+	// Dir is the directory of the spool segment files, the spool is disabled if Dir is empty.
+	Dir string
+	// MaxBytes is the maximum size of the spool, Emit returns ErrSpoolFull once reached. Default value is 1GB.
+	MaxBytes int64
+	// SegmentSize is the size after which a new segment file is started. Default value is 16MB.
+	SegmentSize int64
+	// Fsync defines when segment files are synced to disk. Default value is FsyncInterval.
+	Fsync FsyncPolicy
+	// FsyncInterval is the period between syncs with FsyncInterval. Default value is 1 second.
+	FsyncInterval time.Duration
+	// DrainInterval is the period between attempts to republish the spooled messages. Default value is 1 second.
+	DrainInterval time.Duration
+}
+
+// RetryPolicy carries the configuration of publish retries, the delay before the nth retry
+// is InitialBackoff * Multiplier^(n-1), capped at MaxBackoff and randomized by Jitter.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of publish attempts, including the first one.
+	// Default value is 1, publishes are not retried.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry. Default value is 100 milliseconds.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between retries. Default value is 5 seconds.
+	MaxBackoff time.Duration
+	// Multiplier is the growth factor of the delay between retries. Default value is 2.
+	Multiplier float64
+	// Jitter is the fraction, between 0 and 1, of each delay which is randomized. Default value is 0.
+	Jitter float64
+	// IsRetryable classifies publish errors, only errors for which it returns true are retried.
+	// Defaults to IsRetryableError.
+	IsRetryable func(err error) bool
+}
+
+// RateLimit carries the configuration of the token bucket limiting how often a listener
+// handles messages, the bucket holds up to Burst tokens and is refilled at Rate tokens per second.
+type RateLimit struct {
+	// Rate is the number of messages handled per second, 0 disables rate limiting.
+	Rate float64
+	// Burst is the number of messages handled at once after the listener was idle. Default value is 1.
+	Burst int
+}
+
+// Breaker carries the configuration for circuit breaker, each topic has its own
+// circuit breaker so a failing topic does not trip publishing to the other topics.
 type Breaker struct {
 	// Interval is the cyclic period of the closed state for CircuitBreaker to clear the internal counts,
 	// If Interval is 0, CircuitBreaker doesn't clear the internal counts during the closed state.
@@ -96,6 +305,17 @@ type Breaker struct {
 	// During this state, the circuit breaker will periodically allow the calls to run and, if it is successful,
 	// will start running the function again. Default value is 5.
 	Threshold uint32
+	// MinRequests is the number of requests in the closed state before FailureRatio is evaluated.
+	MinRequests uint32
+	// FailureRatio when greater than 0, trips the breaker once the ratio of failed requests reaches it,
+	// after at least MinRequests requests. It replaces Threshold.
+	FailureRatio float64
+	// ReadyToTrip when set, is called with the counts of each failure and trips the breaker when
+	// it returns true. It replaces Threshold, MinRequests and FailureRatio.
+	ReadyToTrip func(counts BreakerCounts) bool
+	// IsFailure classifies publish errors, errors for which it returns false don't count toward
+	// tripping the breaker. Defaults to any error except validation errors, see IsValidationError.
+	IsFailure func(err error) bool
 	// OnStateChange is called whenever the state of CircuitBreaker changes.
 	OnStateChange func(name, from, to string)
 }
@@ -166,6 +386,61 @@ func newListenerConfig(lc ListenerConfig) (config *nsq.Config) {
 	return
 }
 
+// newReplyListenerConfig returns the configuration of the reply listeners of the requests,
+// connecting with the emitter settings.
+func newReplyListenerConfig(ec EmitterConfig) ListenerConfig {
+	return ListenerConfig{
+		Lookup:              ec.Lookup,
+		DialTimeout:         ec.DialTimeout,
+		ReadTimeout:         ec.ReadTimeout,
+		WriteTimeout:        ec.WriteTimeout,
+		LocalAddr:           ec.LocalAddr,
+		LookupdPollInterval: ec.LookupdPollInterval,
+		LookupdPollJitter:   ec.LookupdPollJitter,
+		ClientID:            ec.ClientID,
+		Hostname:            ec.Hostname,
+		UserAgent:           ec.UserAgent,
+		HeartbeatInterval:   ec.HeartbeatInterval,
+		TLSV1:               ec.TLSV1,
+		TLSConfig:           ec.TLSConfig,
+		Deflate:             ec.Deflate,
+		DeflateLevel:        ec.DeflateLevel,
+		Snappy:              ec.Snappy,
+		AuthSecret:          ec.AuthSecret,
+		TracerProvider:      ec.TracerProvider,
+		Logger:              ec.Logger,
+		LogLevel:            ec.LogLevel,
+	}
+}
+
+// newReplyEmitterConfig returns the EmitterConfig used to publish replies to the nsqd
+// at address, sharing the listener connection and security settings.
+func newReplyEmitterConfig(lc ListenerConfig, address string) EmitterConfig {
+	return EmitterConfig{
+		Address:             address,
+		DialTimeout:         lc.DialTimeout,
+		ReadTimeout:         lc.ReadTimeout,
+		WriteTimeout:        lc.WriteTimeout,
+		LocalAddr:           lc.LocalAddr,
+		ClientID:            lc.ClientID,
+		Hostname:            lc.Hostname,
+		UserAgent:           lc.UserAgent,
+		HeartbeatInterval:   lc.HeartbeatInterval,
+		TLSV1:               lc.TLSV1,
+		TLSConfig:           lc.TLSConfig,
+		Deflate:             lc.Deflate,
+		DeflateLevel:        lc.DeflateLevel,
+		Snappy:              lc.Snappy,
+		OutputBufferSize:    lc.OutputBufferSize,
+		OutputBufferTimeout: lc.OutputBufferTimeout,
+		AuthSecret:          lc.AuthSecret,
+		Metrics:             lc.Metrics,
+		TracerProvider:      lc.TracerProvider,
+		Logger:              lc.Logger,
+		LogLevel:            lc.LogLevel,
+	}
+}
+
 func setDialTimeout(config *nsq.Config, dialTimeout time.Duration) {
 	if dialTimeout != 0 {
 		config.DialTimeout = dialTimeout
@@ -1,6 +1,7 @@
 package bus
 
 import (
+	"crypto/tls"
 	"testing"
 )
 
@@ -19,3 +20,21 @@ func TestNewListenerConfig(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestNewReplyEmitterConfig(t *testing.T) {
+	tlsConfig := &tls.Config{}
+	c := newReplyEmitterConfig(ListenerConfig{
+		TLSV1:      true,
+		TLSConfig:  tlsConfig,
+		AuthSecret: "foo",
+		ClientID:   "bar",
+	}, "nsqd:4150")
+
+	if c.Address != "nsqd:4150" {
+		t.Errorf("unexpected address %s", c.Address)
+	}
+
+	if !c.TLSV1 || c.TLSConfig != tlsConfig || c.AuthSecret != "foo" || c.ClientID != "bar" {
+		t.Errorf("expected reply emitter config to carry listener settings %+v", c)
+	}
+}
@@ -0,0 +1,112 @@
+package bus
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Deduplicator records the IDs of the processed messages, so redelivered messages
+// are finished without calling HandlerFunc again. Listeners pass IDs prefixed by their
+// channel, e.g. "billing:<uuid>", so a Deduplicator can be shared by several channels.
+type Deduplicator interface {
+	// Processed reports whether the message id was already processed.
+	Processed(ctx context.Context, id string) (bool, error)
+	// MarkProcessed records the message id as processed.
+	MarkProcessed(ctx context.Context, id string) error
+}
+
+type (
+	// memoryDeduplicator is an in-memory Deduplicator evicting the least recently
+	// processed IDs once full and the IDs older than its ttl.
+	memoryDeduplicator struct {
+		mu      sync.Mutex
+		size    int
+		ttl     time.Duration
+		entries map[string]*list.Element
+		order   *list.List
+	}
+
+	dedupEntry struct {
+		id        string
+		expiresAt time.Time
+	}
+)
+
+// NewMemoryDeduplicator returns an in-memory Deduplicator remembering up to size IDs
+// for ttl, a ttl of 0 keeps IDs until evicted. IDs are not shared between processes
+// nor kept across restarts.
+func NewMemoryDeduplicator(size int, ttl time.Duration) Deduplicator {
+	return &memoryDeduplicator{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (d *memoryDeduplicator) Processed(ctx context.Context, id string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	el, ok := d.entries[id]
+	if !ok {
+		return false, nil
+	}
+
+	if d.expired(el.Value.(*dedupEntry), time.Now()) {
+		d.remove(el)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func (d *memoryDeduplicator) MarkProcessed(ctx context.Context, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	entry := &dedupEntry{id: id}
+	if d.ttl > 0 {
+		entry.expiresAt = now.Add(d.ttl)
+	}
+
+	if el, ok := d.entries[id]; ok {
+		el.Value = entry
+		d.order.MoveToFront(el)
+		return nil
+	}
+
+	d.entries[id] = d.order.PushFront(entry)
+
+	for el := d.order.Back(); el != nil && (d.order.Len() > d.size || d.expired(el.Value.(*dedupEntry), now)); el = d.order.Back() {
+		d.remove(el)
+	}
+
+	return nil
+}
+
+func (d *memoryDeduplicator) expired(e *dedupEntry, now time.Time) bool {
+	return !e.expiresAt.IsZero() && now.After(e.expiresAt)
+}
+
+func (d *memoryDeduplicator) remove(el *list.Element) {
+	d.order.Remove(el)
+	delete(d.entries, el.Value.(*dedupEntry).id)
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,139 @@
+package bus
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestDeduplicator(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		scenario string
+		function func(*testing.T)
+	}{
+		{
+			"memory lru eviction",
+			testMemoryDeduplicatorLRU,
+		},
+		{
+			"memory ttl",
+			testMemoryDeduplicatorTTL,
+		},
+		{
+			"handler skips duplicates",
+			testHandlerDeduplicator,
+		},
+		{
+			"channels sharing a deduplicator",
+			testHandlerDeduplicatorChannels,
+		},
+		{
+			"message uuid",
+			testMessageUUID,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			test.function(t)
+		})
+	}
+}
+
+func testMemoryDeduplicatorLRU(t *testing.T) {
+	ctx := context.Background()
+	d := NewMemoryDeduplicator(2, 0)
+	d.MarkProcessed(ctx, "a")
+	d.MarkProcessed(ctx, "b")
+	d.MarkProcessed(ctx, "a")
+	d.MarkProcessed(ctx, "c")
+
+	for id, expected := range map[string]bool{"a": true, "b": false, "c": true, "d": false} {
+		if dup, err := d.Processed(ctx, id); err != nil || dup != expected {
+			t.Errorf("%s: unexpected processed %v %v", id, dup, err)
+		}
+	}
+}
+
+func testMemoryDeduplicatorTTL(t *testing.T) {
+	ctx := context.Background()
+	d := NewMemoryDeduplicator(10, time.Millisecond*20)
+	d.MarkProcessed(ctx, "a")
+
+	if dup, _ := d.Processed(ctx, "a"); !dup {
+		t.Error("expected id to be processed")
+	}
+
+	time.Sleep(time.Millisecond * 30)
+	if dup, _ := d.Processed(ctx, "a"); dup {
+		t.Error("expected id to expire")
+	}
+}
+
+func testHandlerDeduplicator(t *testing.T) {
+	calls := 0
+	h := newHandler(context.Background(), ListenerConfig{
+		Topic:        "orders",
+		Channel:      "billing",
+		Deduplicator: NewMemoryDeduplicator(10, time.Minute),
+		HandlerFunc: func(ctx context.Context, message *Message) (interface{}, error) {
+			calls++
+			return nil, nil
+		},
+	})
+
+	m := NewMessage([]byte(`"event"`), "")
+	for i := 0; i < 3; i++ {
+		if err := h.HandleMessage(newNSQMessage(t, m)); err != nil {
+			t.Fatalf("expected message to be handled %v", err)
+		}
+	}
+
+	h.HandleMessage(newNSQMessage(t, NewMessage([]byte(`"other"`), "")))
+
+	if calls != 2 {
+		t.Errorf("expected duplicates not to be handled %d", calls)
+	}
+}
+
+func testHandlerDeduplicatorChannels(t *testing.T) {
+	dedup := NewMemoryDeduplicator(10, time.Minute)
+	calls := make(map[string]int)
+	newChannelHandler := func(channel string) *handler {
+		return newHandler(context.Background(), ListenerConfig{
+			Topic:        "orders",
+			Channel:      channel,
+			Deduplicator: dedup,
+			HandlerFunc: func(ctx context.Context, message *Message) (interface{}, error) {
+				calls[channel]++
+				return nil, nil
+			},
+		})
+	}
+
+	billing, shipping := newChannelHandler("billing"), newChannelHandler("shipping")
+	m := NewMessage([]byte(`"event"`), "")
+	for i := 0; i < 2; i++ {
+		billing.HandleMessage(newNSQMessage(t, m))
+		shipping.HandleMessage(newNSQMessage(t, m))
+	}
+
+	if calls["billing"] != 1 || calls["shipping"] != 1 {
+		t.Errorf("expected every channel to process the message once %v", calls)
+	}
+
+	if dup, _ := dedup.Processed(context.Background(), "billing:"+m.UUID); !dup {
+		t.Error("expected processed id to be scoped by channel")
+	}
+}
+
+func testMessageUUID(t *testing.T) {
+	a, b := NewMessage(nil, ""), NewMessage(nil, "")
+	pattern := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	if !pattern.MatchString(a.UUID) || a.UUID == b.UUID {
+		t.Errorf("unexpected message uuids %s %s", a.UUID, b.UUID)
+	}
+}
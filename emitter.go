@@ -1,25 +1,65 @@
 package bus
 
 import (
+	"container/list"
+	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"net/http"
-	"strconv"
-	"strings"
+	"sync"
+	"time"
 
 	nsq "github.com/nsqio/go-nsq"
 	"github.com/sony/gobreaker"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// ErrQuorumNotReached is returned by RequestAll when ctx is done before RequestOptions.Quorum replies were received.
+var ErrQuorumNotReached = errors.New("quorum not reached")
+
 type (
 	// Emitter is the emitter wrapper over nsq.
 	Emitter struct {
 		producer *nsq.Producer
-		address  string
-		breaker  *gobreaker.CircuitBreaker
+		admin    *Admin
+		hostname string
+		clientID string
+		metrics  *Metrics
+		tracer   trace.Tracer
+		logger   Logger
+
+		breakerConfig Breaker
+		breakersMu    sync.Mutex
+		breakers      map[string]*gobreaker.CircuitBreaker
+
+		requestTimeout time.Duration
+		replyListener  ListenerConfig
+
+		idempotency Deduplicator
+		retry       RetryPolicy
+		partitions  int
+		seqMu       sync.Mutex
+		seqs        map[string]*list.Element
+		seqOrder    *list.List
+
+		spool     *spool
+		stopDrain chan struct{}
+		drainDone chan struct{}
+		async     sync.WaitGroup
+	}
+
+	// RequestOptions tunes how RequestAll gathers replies.
+	RequestOptions struct {
+		// Count stops gathering once Count replies were received.
+		// If Count is 0, replies are gathered until ctx is done.
+		Count int
+		// Quorum is the minimum number of replies expected before ctx is done.
+		Quorum int
+		// StopAtQuorum when enabled, gathering stops as soon as Quorum replies were received.
+		StopAtQuorum bool
 	}
 )
 
@@ -34,72 +74,248 @@ func NewEmitter(ec EmitterConfig) (*Emitter, error) {
 		address = "localhost:4150"
 	}
 
+	admin := ec.Admin
+	if admin == nil {
+		var err error
+		if admin, err = newEmitterAdmin(ec, address); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, topic := range ec.Topics {
+		if err := admin.CreateTopic(topic); err != nil {
+			return nil, err
+		}
+	}
+
 	producer, err := nsq.NewProducer(address, config)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Emitter{
+	logger := newLogger(ec.Logger, ec.LogLevel)
+	producer.SetLogger(nsqLogger{logger}, ec.LogLevel.nsqLogLevel())
+
+	emitter := &Emitter{
 		producer: producer,
-		address:  address,
-		breaker:  gobreaker.NewCircuitBreaker(newBreakerSettings(ec.Breaker)),
-	}, nil
+		admin:    admin,
+		hostname: config.Hostname,
+		clientID: config.ClientID,
+		metrics:  ec.Metrics,
+		tracer:   newTracer(ec.TracerProvider),
+		logger:   logger,
+
+		requestTimeout: ec.RequestTimeout,
+		replyListener:  newReplyListenerConfig(ec),
+
+		retry:         ec.Retry,
+		partitions:    ec.Partitions,
+		seqs:          make(map[string]*list.Element),
+		seqOrder:      list.New(),
+		breakerConfig: ec.Breaker,
+		breakers:      make(map[string]*gobreaker.CircuitBreaker),
+	}
+
+	if emitter.requestTimeout <= 0 {
+		emitter.requestTimeout = time.Minute
+	}
+
+	if ec.IdempotencyCacheTTL >= 0 {
+		ttl := ec.IdempotencyCacheTTL
+		if ttl == 0 {
+			ttl = time.Minute
+		}
+
+		size := ec.IdempotencyCacheSize
+		if size == 0 {
+			size = 10000
+		}
+
+		emitter.idempotency = NewMemoryDeduplicator(size, ttl)
+	}
+
+	if ec.Spool.Dir != "" {
+		spool, err := openSpool(ec.Spool)
+		if err != nil {
+			producer.Stop()
+			return nil, err
+		}
+
+		drainInterval := ec.Spool.DrainInterval
+		if drainInterval == 0 {
+			drainInterval = time.Second
+		}
+
+		fsyncInterval := ec.Spool.FsyncInterval
+		if fsyncInterval == 0 {
+			fsyncInterval = time.Second
+		}
+
+		emitter.spool = spool
+		emitter.stopDrain = make(chan struct{})
+		emitter.drainDone = make(chan struct{})
+		go emitter.drain(emitter.stopDrain, emitter.drainDone, drainInterval, fsyncInterval)
+	}
+
+	return emitter, nil
+}
+
+// newEmitterAdmin returns the Admin of nsqd at HTTPAddress sharing the TLS and auth
+// settings of the producer, or of the plain HTTP API at the port following the TCP
+// port of address, nsqd serves HTTPS on a separate address.
+func newEmitterAdmin(ec EmitterConfig, address string) (*Admin, error) {
+	if len(ec.HTTPAddress) == 0 {
+		httpAddr, err := httpAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		return NewAdmin(AdminConfig{Address: httpAddr, Lookup: ec.Lookup}), nil
+	}
+
+	tlsConfig := ec.TLSConfig
+	if tlsConfig == nil && ec.TLSV1 {
+		tlsConfig = &tls.Config{}
+	}
+
+	return NewAdmin(AdminConfig{
+		Address:    ec.HTTPAddress,
+		Lookup:     ec.Lookup,
+		TLSConfig:  tlsConfig,
+		AuthSecret: ec.AuthSecret,
+	}), nil
 }
 
 // Emit emits a message to a specific topic using nsq producer, returning
 // an error if encoding payload fails or if an error occurred while publishing
 // the message.
-func (e *Emitter) Emit(topic string, payload interface{}) error {
+func (e *Emitter) Emit(topic string, payload interface{}, opts ...EmitOption) error {
 	if len(topic) == 0 {
 		return ErrTopicRequired
 	}
 
-	body, err := e.encodeMessage(payload, "")
+	o := newEmitOptions(opts)
+	if e.emitted(o.ctx, o.idempotencyKey) {
+		return nil
+	}
+
+	m, err := e.encodeMessage(payload, "")
 	if err != nil {
 		return err
 	}
+	o.apply(m)
+	topic = e.partition(topic, o.partitionKey, m)
 
-	_, err = e.breaker.Execute(func() (interface{}, error) {
-		return nil, e.producer.Publish(topic, body)
-	})
+	if err := e.send(o.ctx, topic, m, e.emit); err != nil {
+		e.releaseSeq(m)
+		return err
+	}
 
-	return err
+	e.markEmitted(o.ctx, o.idempotencyKey)
+	return nil
 }
 
 // Emit emits a message to a specific topic using nsq producer, but does not wait for
 // the response from `nsqd`. Returns an error if encoding payload fails and
 // logs to console if an error occurred while publishing the message.
-func (e *Emitter) EmitAsync(topic string, payload interface{}) error {
+func (e *Emitter) EmitAsync(topic string, payload interface{}, opts ...EmitOption) error {
 	if len(topic) == 0 {
 		return ErrTopicRequired
 	}
 
-	body, err := e.encodeMessage(payload, "")
+	o := newEmitOptions(opts)
+	if e.emitted(o.ctx, o.idempotencyKey) {
+		return nil
+	}
+
+	m, err := e.encodeMessage(payload, "")
 	if err != nil {
 		return err
 	}
+	o.apply(m)
+	topic = e.partition(topic, o.partitionKey, m)
+
+	_, span := startProducerSpan(o.ctx, e.tracer, topic, m)
+	body, err := json.Marshal(m)
+	if err != nil {
+		endSpan(span, err)
+		return err
+	}
+
+	if e.spool != nil && !e.spool.empty() {
+		err = e.spool.append(topic, body)
+		endSpan(span, err)
+		if err != nil {
+			e.releaseSeq(m)
+			return err
+		}
+		e.markEmitted(o.ctx, o.idempotencyKey)
+		return nil
+	}
 
+	start := time.Now()
 	responseChan := make(chan *nsq.ProducerTransaction, 1)
-	go func(responseChan chan *nsq.ProducerTransaction) {
-		for {
-			trans, ok := <-responseChan
-			if ok && trans.Error != nil {
-				log.Fatalf(trans.Error.Error())
-			}
+	e.metrics.addAsyncPending(topic, 1)
+	err = e.execute(o.ctx, topic, func() error {
+		return e.producer.PublishAsync(topic, body, responseChan, "")
+	})
+	if err != nil {
+		e.metrics.addAsyncPending(topic, -1)
+		e.metrics.observePublish(topic, start, err)
+		err = e.spoolFailed(topic, body, err)
+		endSpan(span, err)
+		if err != nil {
+			e.releaseSeq(m)
+			return err
 		}
-	}(responseChan)
+		e.markEmitted(o.ctx, o.idempotencyKey)
+		return nil
+	}
+
+	e.async.Add(1)
+	go func() {
+		defer e.async.Done()
+		trans := <-responseChan
+		e.metrics.addAsyncPending(topic, -1)
+		e.metrics.observePublish(topic, start, trans.Error)
+		err := e.spoolFailed(topic, body, trans.Error)
+		endSpan(span, err)
+		if err != nil {
+			e.logger.Error("failed to publish message", "topic", topic, "error", err)
+			e.releaseSeq(m)
+			return
+		}
+
+		// marked once nsqd or the spool kept the message, a failed publish can be retried
+		e.markEmitted(context.Background(), o.idempotencyKey)
+	}()
+
+	return nil
+}
 
-	_, err = e.breaker.Execute(func() (interface{}, error) {
-		return nil, e.producer.PublishAsync(topic, body, responseChan, "")
+// MultiPublish publishes already encoded messages to topic in a single round trip to nsqd,
+// within the circuit breaker of topic. It relays messages encoded ahead of time, e.g. by
+// the outbox package, bodies are expected to be encoded bus.Message.
+func (e *Emitter) MultiPublish(topic string, bodies [][]byte) error {
+	if len(topic) == 0 {
+		return ErrTopicRequired
+	}
+
+	start := time.Now()
+	err := e.execute(context.Background(), topic, func() error {
+		return e.producer.MultiPublish(topic, bodies)
 	})
 
+	e.metrics.observePublish(topic, start, err)
 	return err
 }
 
 // Request a RPC like method which implements request/reply pattern using nsq producer and consumer.
+// handler is called with every reply, the internal reply listener is stopped once the last reply
+// was handled or after RequestTimeout. The WithContext option carries the parent span of the
+// request, WithType and WithIdempotencyKey set the envelope of the request message.
 // Returns an non-nil err if an error occurred while creating or listening to the internal
 // reply topic or encoding the message payload fails or while publishing the message.
-func (e *Emitter) Request(topic string, payload interface{}, handler HandlerFunc) error {
+func (e *Emitter) Request(topic string, payload interface{}, handler HandlerFunc, opts ...EmitOption) error {
 	if len(topic) == 0 {
 		return ErrTopicRequired
 	}
@@ -108,43 +324,266 @@ func (e *Emitter) Request(topic string, payload interface{}, handler HandlerFunc
 		return ErrHandlerRequired
 	}
 
-	replyTo, err := e.genReplyQueue()
+	o := newEmitOptions(opts)
+
+	start := time.Now()
+	var once sync.Once
+	done := make(chan struct{})
+	replyTo, listener, err := e.listenReplies(func(ctx context.Context, m *Message) (interface{}, error) {
+		e.metrics.observeRequest(topic, start)
+		if m.EOS {
+			defer once.Do(func() { close(done) })
+		}
+		return handler(ctx, m)
+	})
 	if err != nil {
 		return err
 	}
 
-	if err := e.createTopic(replyTo); err != nil {
-		return err
+	m, err := e.encodeMessage(payload, replyTo)
+	if err == nil {
+		o.apply(m)
+		err = e.send(o.ctx, topic, m, e.publish)
 	}
 
-	if err := On(ListenerConfig{
-		Topic:       replyTo,
-		Channel:     replyTo,
-		HandlerFunc: handler,
-	}); err != nil {
+	if err != nil {
+		listener.Stop()
 		return err
 	}
 
-	body, err := e.encodeMessage(payload, replyTo)
+	go func() {
+		timer := time.NewTimer(e.requestTimeout)
+		defer timer.Stop()
+
+		select {
+		case <-done:
+		case <-timer.C:
+			e.logger.Warn("request timed out waiting for replies", "topic", topic, "reply_to", replyTo)
+		}
+		listener.Stop()
+	}()
+
+	return nil
+}
+
+// RequestAll publishes a single request and gathers every reply arriving on the internal
+// reply topic until opts.Count replies were received, opts.Quorum replies were received
+// with opts.StopAtQuorum, or ctx is done, the replies carry the Hostname and ClientID of the responders. Returns the gathered replies along with
+// ErrQuorumNotReached if ctx is done before opts.Quorum replies were received.
+func (e *Emitter) RequestAll(ctx context.Context, topic string, payload interface{}, opts RequestOptions) ([]*Message, error) {
+	if len(topic) == 0 {
+		return nil, ErrTopicRequired
+	}
+
+	start := time.Now()
+	replies := make(chan *Message)
+	replyTo, listener, err := e.listenReplies(func(ctx context.Context, m *Message) (interface{}, error) {
+		e.metrics.observeRequest(topic, start)
+		select {
+		case replies <- m:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer listener.Stop()
+
+	m, err := e.encodeMessage(payload, replyTo)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.send(ctx, topic, m, e.publish); err != nil {
+		return nil, err
+	}
+
+	return gatherReplies(ctx, replies, opts)
+}
+
+// gatherReplies receives replies until the stop condition of opts is met or ctx is done.
+func gatherReplies(ctx context.Context, replies <-chan *Message, opts RequestOptions) ([]*Message, error) {
+	var gathered []*Message
+	for opts.Count == 0 || len(gathered) < opts.Count {
+		if opts.StopAtQuorum && opts.Quorum > 0 && len(gathered) >= opts.Quorum {
+			break
+		}
+
+		select {
+		case m := <-replies:
+			gathered = append(gathered, m)
+		case <-ctx.Done():
+			if len(gathered) < opts.Quorum {
+				return gathered, ErrQuorumNotReached
+			}
+			return gathered, nil
+		}
+	}
+
+	return gathered, nil
+}
+
+// listenReplies creates the internal reply topic and starts listening to it.
+func (e *Emitter) listenReplies(handler HandlerFunc) (string, *Listener, error) {
+	replyTo, err := e.genReplyQueue()
+	if err != nil {
+		return "", nil, err
 	}
 
-	_, err = e.breaker.Execute(func() (interface{}, error) {
-		return nil, e.producer.Publish(topic, body)
+	if err := e.admin.CreateTopic(replyTo); err != nil {
+		return "", nil, err
+	}
+
+	lc := e.replyListener
+	lc.Topic = replyTo
+	lc.Channel = replyTo
+	lc.HandlerFunc = handler
+	listener, err := NewListener(lc)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return replyTo, listener, nil
+}
+
+// reply emits a reply to topic, carrying either the payload or rerr, at position seq
+// of the reply stream.
+func (e *Emitter) reply(ctx context.Context, topic string, seq int, eos bool, payload interface{}, rerr *RemoteError) error {
+	m := e.newMessage(nil, "")
+	m.Seq = seq
+	m.EOS = eos
+	m.Error = rerr
+	if rerr == nil {
+		p, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		m.Payload = p
+	}
+
+	return e.send(ctx, topic, m, e.publish)
+}
+
+// send publishes the message with publish within a producer span, propagating its trace context.
+func (e *Emitter) send(ctx context.Context, topic string, m *Message, publish func(ctx context.Context, topic string, body []byte) error) error {
+	_, span := startProducerSpan(ctx, e.tracer, topic, m)
+	body, err := json.Marshal(m)
+	if err == nil {
+		err = publish(ctx, topic, body)
+	}
+
+	endSpan(span, err)
+	return err
+}
+
+func (e *Emitter) publish(ctx context.Context, topic string, body []byte) error {
+	start := time.Now()
+	err := e.execute(ctx, topic, func() error {
+		return e.producer.Publish(topic, body)
 	})
 
+	e.metrics.observePublish(topic, start, err)
 	return err
 }
 
-func (e *Emitter) encodeMessage(payload interface{}, replyTo string) ([]byte, error) {
+// emit publishes body, appending it to the spool when enabled and publishing failed,
+// or when the spool has messages not yet drained so they keep their order.
+func (e *Emitter) emit(ctx context.Context, topic string, body []byte) error {
+	if e.spool != nil && !e.spool.empty() {
+		return e.spool.append(topic, body)
+	}
+
+	return e.spoolFailed(topic, body, e.publish(ctx, topic, body))
+}
+
+// spoolFailed appends body to the spool when enabled and err counts as a breaker
+// failure, otherwise it returns err.
+func (e *Emitter) spoolFailed(topic string, body []byte, err error) error {
+	if err == nil || e.spool == nil || !e.breakerConfig.isFailure(err) {
+		return err
+	}
+
+	if err := e.spool.append(topic, body); err != nil {
+		return err
+	}
+
+	e.logger.Debug("spooled message", "topic", topic, "error", err)
+	return nil
+}
+
+// partition numbers m within the messages of the partition key and returns the
+// topic it is published to.
+func (e *Emitter) partition(topic, key string, m *Message) string {
+	if key == "" {
+		return topic
+	}
+
+	m.PartitionKey = key
+	m.PartitionSeq = e.nextSeq(key)
+	if e.partitions > 0 {
+		return PartitionTopic(topic, key, e.partitions)
+	}
+
+	return topic
+}
+
+// emitted reports whether a message with the idempotency key was recently emitted.
+func (e *Emitter) emitted(ctx context.Context, key string) bool {
+	if key == "" || e.idempotency == nil {
+		return false
+	}
+
+	dup, _ := e.idempotency.Processed(ctx, key)
+	if dup {
+		e.logger.Debug("dropped duplicate emit", "idempotency_key", key)
+	}
+
+	return dup
+}
+
+func (e *Emitter) markEmitted(ctx context.Context, key string) {
+	if key != "" && e.idempotency != nil {
+		e.idempotency.MarkProcessed(ctx, key)
+	}
+}
+
+// Stop stops the spool drainer and gracefully stops the nsq producer, the asynchronous
+// publishes still in flight are spooled when failing before the spool is closed.
+func (e *Emitter) Stop() {
+	if e.spool != nil {
+		close(e.stopDrain)
+		<-e.drainDone
+	}
+
+	e.producer.Stop()
+	e.async.Wait()
+
+	if e.spool != nil {
+		if err := e.spool.close(); err != nil {
+			e.logger.Error("failed to close spool", "error", err)
+		}
+	}
+}
+
+func (e *Emitter) encodeMessage(payload interface{}, replyTo string) (*Message, error) {
 	p, err := json.Marshal(payload)
 	if err != nil {
 		return nil, err
 	}
 
-	message := NewMessage(p, replyTo)
-	return json.Marshal(message)
+	m := e.newMessage(p, replyTo)
+	m.Type = TypeName(payload)
+	return m, nil
+}
+
+// newMessage returns a new bus.Message identifying this emitter as its sender.
+func (e *Emitter) newMessage(p []byte, replyTo string) *Message {
+	m := NewMessage(p, replyTo)
+	m.Hostname = e.hostname
+	m.ClientID = e.clientID
+	return m
 }
 
 func (e *Emitter) genReplyQueue() (string, error) {
@@ -156,29 +595,3 @@ func (e *Emitter) genReplyQueue() (string, error) {
 	hash := hex.EncodeToString(b)
 	return fmt.Sprint(hash, ".ephemeral"), nil
 }
-
-func (e *Emitter) createTopic(topic string) error {
-	s := strings.Split(e.address, ":")
-	port, err := strconv.Atoi(s[1])
-	if err != nil {
-		return err
-	}
-
-	uri := fmt.Sprintf("http://%s:%s/topic/create?topic=%s", s[0], strconv.Itoa(port+1), topic)
-	_, err = http.Post(uri, "application/json; charset=utf-8", nil)
-	return err
-}
-
-func newBreakerSettings(c Breaker) gobreaker.Settings {
-	return gobreaker.Settings{
-		Name:     "nsq-emitter-circuit-breaker",
-		Interval: c.Interval,
-		Timeout:  c.Timeout,
-		ReadyToTrip: func(counts gobreaker.Counts) bool {
-			return counts.ConsecutiveFailures > c.Threshold
-		},
-		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
-			c.OnStateChange(name, from.String(), to.String())
-		},
-	}
-}
@@ -1,7 +1,12 @@
 package bus
 
 import (
+	"context"
 	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -30,6 +35,30 @@ func TestEmitter(t *testing.T) {
 			"request message",
 			testRequestMessage,
 		},
+		{
+			"request all validation",
+			testRequestAllValidation,
+		},
+		{
+			"request all gathering",
+			testGatherReplies,
+		},
+		{
+			"request reply listener lookup",
+			testRequestReplyLookup,
+		},
+		{
+			"admin settings",
+			testEmitterAdmin,
+		},
+		{
+			"default admin with tls producer",
+			testEmitterDefaultAdmin,
+		},
+		{
+			"encode message",
+			testEncodeMessage,
+		},
 	}
 
 	for _, test := range tests {
@@ -124,7 +153,7 @@ func testRequestMessage(t *testing.T) {
 
 	var wg sync.WaitGroup
 	wg.Add(1)
-	replyHandler := func(message *Message) (reply interface{}, err error) {
+	replyHandler := func(ctx context.Context, message *Message) (reply interface{}, err error) {
 		defer wg.Done()
 		e := event{}
 		if err = message.DecodePayload(&e); err != nil {
@@ -137,7 +166,7 @@ func testRequestMessage(t *testing.T) {
 		return
 	}
 
-	handler := func(message *Message) (reply interface{}, err error) {
+	handler := func(ctx context.Context, message *Message) (reply interface{}, err error) {
 		e := event{}
 		if err = message.DecodePayload(&e); err != nil {
 			t.Errorf("Expected to unmarshal payload")
@@ -158,7 +187,7 @@ func testRequestMessage(t *testing.T) {
 	cases := []struct {
 		topic   string
 		event   event
-		replyh  func(message *Message) (interface{}, error)
+		replyh  HandlerFunc
 		wantErr bool
 	}{
 		{
@@ -187,6 +216,175 @@ func testRequestMessage(t *testing.T) {
 	wg.Wait()
 }
 
+func testRequestAllValidation(t *testing.T) {
+	emitter, err := NewEmitter(EmitterConfig{})
+	if err != nil {
+		t.Fatalf("expected to initialize emitter %v", err)
+	}
+	defer emitter.Stop()
+
+	if _, err := emitter.RequestAll(context.Background(), "", nil, RequestOptions{}); err != ErrTopicRequired {
+		t.Fatalf("unexpected error value %v", err)
+	}
+}
+
+func testGatherReplies(t *testing.T) {
+	cases := []struct {
+		msg      string
+		opts     RequestOptions
+		expected int
+		err      error
+	}{
+		{"count", RequestOptions{Count: 2}, 2, nil},
+		{"quorum checked at deadline", RequestOptions{Quorum: 2}, 3, nil},
+		{"stop at quorum", RequestOptions{Quorum: 2, StopAtQuorum: true}, 2, nil},
+		{"quorum not reached", RequestOptions{Quorum: 4}, 3, ErrQuorumNotReached},
+	}
+
+	for _, c := range cases {
+		replies := make(chan *Message, 3)
+		for i := 0; i < 3; i++ {
+			replies <- &Message{Seq: i}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+		start := time.Now()
+		gathered, err := gatherReplies(ctx, replies, c.opts)
+		cancel()
+
+		if len(gathered) != c.expected || err != c.err {
+			t.Errorf("%s: expected %d replies and %v, got %d and %v", c.msg, c.expected, c.err, len(gathered), err)
+		}
+
+		if c.opts.StopAtQuorum && time.Since(start) >= time.Millisecond*20 {
+			t.Errorf("%s: expected to return before the deadline", c.msg)
+		}
+	}
+}
+
+func testRequestReplyLookup(t *testing.T) {
+	nsqd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer nsqd.Close()
+
+	var (
+		mu      sync.Mutex
+		lookups []string
+	)
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		lookups = append(lookups, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer lookupd.Close()
+
+	emitter, err := NewEmitter(EmitterConfig{
+		Address:  "127.0.0.1:1",
+		Admin:    NewAdmin(AdminConfig{Address: serverAddress(nsqd)}),
+		Lookup:   []string{serverAddress(lookupd)},
+		LogLevel: LogError,
+		Logger:   &loggerMock{},
+	})
+	if err != nil {
+		t.Fatalf("expected to initialize emitter %v", err)
+	}
+	defer emitter.Stop()
+
+	handler := func(ctx context.Context, m *Message) (interface{}, error) { return nil, nil }
+	if err := emitter.Request("pricing", "event", handler); err == nil {
+		t.Fatal("expected request to fail without nsqd")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(lookups) == 0 || lookups[0] != "/lookup" {
+		t.Errorf("expected reply listener to query the configured nsqlookupd, got %v", lookups)
+	}
+}
+
+func testEmitterAdmin(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	nsqd := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.URL.Path+" "+r.Header.Get("Authorization"))
+	}))
+	defer nsqd.Close()
+
+	emitter, err := NewEmitter(EmitterConfig{
+		HTTPAddress: nsqd.Listener.Addr().String(),
+		TLSConfig:   &tls.Config{InsecureSkipVerify: true},
+		AuthSecret:  "secret",
+		Topics:      []string{"orders"},
+	})
+	if err != nil {
+		t.Fatalf("expected to create topics through the configured nsqd HTTPS API %v", err)
+	}
+	defer emitter.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 1 || requests[0] != "/topic/create Bearer secret" {
+		t.Errorf("unexpected admin requests %v", requests)
+	}
+}
+
+func testEmitterDefaultAdmin(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	nsqd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.URL.Path+" "+r.Header.Get("Authorization"))
+	}))
+	defer nsqd.Close()
+
+	host, port, _ := net.SplitHostPort(serverAddress(nsqd))
+	p, _ := strconv.Atoi(port)
+
+	emitter, err := NewEmitter(EmitterConfig{
+		Address:    net.JoinHostPort(host, strconv.Itoa(p-1)),
+		TLSV1:      true,
+		AuthSecret: "secret",
+		Topics:     []string{"orders"},
+	})
+	if err != nil {
+		t.Fatalf("expected to create topics through the nsqd HTTP API %v", err)
+	}
+	defer emitter.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 1 || requests[0] != "/topic/create " {
+		t.Errorf("expected a plain HTTP request without the nsqd auth secret %v", requests)
+	}
+}
+
+func testEncodeMessage(t *testing.T) {
+	emitter, err := NewEmitter(EmitterConfig{
+		Hostname: "pricing-1.local",
+		ClientID: "pricing-1",
+	})
+	if err != nil {
+		t.Fatalf("expected to initialize emitter %v", err)
+	}
+	defer emitter.Stop()
+
+	m, err := emitter.encodeMessage(map[string]string{"name": "event"}, "reply")
+	if err != nil {
+		t.Fatalf("expected to encode message %v", err)
+	}
+
+	if m.ReplyTo != "reply" || m.Hostname != "pricing-1.local" || m.ClientID != "pricing-1" {
+		t.Errorf("unexpected message %+v", m)
+	}
+}
+
 type localAddrMock struct{}
 
 func (a *localAddrMock) Network() (s string) { return }
@@ -1,10 +1,18 @@
 package bus
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"path"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
 
 	nsq "github.com/nsqio/go-nsq"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -16,23 +24,78 @@ var (
 	ErrChannelRequired = errors.New("channel is mandatory")
 )
 
-// HandlerFunc is the handler function to handle the massage.
-type HandlerFunc func(m *Message) (interface{}, error)
+// defaultMsgTimeout is the nsqd default used when MsgTimeout is not configured.
+const defaultMsgTimeout = time.Minute
+
+// HandlerFunc is the handler function to handle the massage, ctx is cancelled
+// once the message deadline is exceeded or the listener is stopped.
+type HandlerFunc func(ctx context.Context, m *Message) (interface{}, error)
+
+// Listener is the listener wrapper over the nsq consumers of its topics.
+type Listener struct {
+	lc      ListenerConfig
+	config  *nsq.Config
+	logger  Logger
+	admin   *Admin
+	ctx     context.Context
+	cancel  context.CancelFunc
+	limiter *rateLimiter
+
+	mu            sync.Mutex
+	subscriptions map[string]*subscription
+	connecting    map[string]*handler
+	throttled     bool
+	paused        bool
+	discoveryDone chan struct{}
+}
+
+// subscription is the nsq consumer of one topic of a Listener.
+type subscription struct {
+	consumer *nsq.Consumer
+	handler  *handler
+}
+
+// PanicError is returned when HandlerFunc panics, it carries the recovered
+// value and the stack trace of the panicking goroutine.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+// Error returns the recovered value followed by the stack trace.
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("handler panic: %v\n%s", e.Value, e.Stack)
+}
 
 // On listen to a message from a specific topic using nsq consumer, returns
 // an error if topic and channel not passed or if an error occurred while creating
 // nsq consumer.
 func On(lc ListenerConfig) error {
-	if len(lc.Topic) == 0 {
-		return ErrTopicRequired
+	_, err := NewListener(lc)
+	return err
+}
+
+// NewListener returns a new Listener connected to nsqlookupd and consuming from
+// the configured topics and channel, returns an error if topic and channel not passed
+// or if an error occurred while creating nsq consumer.
+func NewListener(lc ListenerConfig) (*Listener, error) {
+	topics := lc.topics()
+	if len(topics) == 0 && len(lc.TopicPattern) == 0 && lc.TopicRegexp == nil {
+		return nil, ErrTopicRequired
+	}
+
+	if len(lc.TopicPattern) != 0 {
+		if _, err := path.Match(lc.TopicPattern, ""); err != nil {
+			return nil, err
+		}
 	}
 
 	if len(lc.Channel) == 0 {
-		return ErrChannelRequired
+		return nil, ErrChannelRequired
 	}
 
-	if lc.HandlerFunc == nil {
-		return ErrHandlerRequired
+	if lc.HandlerFunc == nil && lc.BatchHandlerFunc == nil {
+		return nil, ErrHandlerRequired
 	}
 
 	if len(lc.Lookup) == 0 {
@@ -43,38 +106,703 @@ func On(lc ListenerConfig) error {
 		lc.HandlerConcurrency = 1
 	}
 
-	config := newListenerConfig(lc)
-	consumer, err := nsq.NewConsumer(lc.Topic, lc.Channel, config)
+	admin := lc.Admin
+	if admin == nil {
+		admin = NewAdmin(AdminConfig{Lookup: lc.Lookup})
+	}
+
+	if lc.EnsureTopology {
+		for _, topic := range topics {
+			if err := ensureTopology(admin, topic, lc.Channel); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &Listener{
+		lc:            lc,
+		config:        newListenerConfig(lc),
+		logger:        newLogger(lc.Logger, lc.LogLevel),
+		admin:         admin,
+		ctx:           ctx,
+		cancel:        cancel,
+		subscriptions: make(map[string]*subscription),
+		connecting:    make(map[string]*handler),
+	}
+	l.limiter = newRateLimiter(lc.RateLimit, l.throttle)
+
+	for _, topic := range topics {
+		if err := l.subscribe(topic); err != nil {
+			l.Stop()
+			return nil, err
+		}
+	}
+
+	if lc.discovers() {
+		if err := l.discover(admin); err != nil {
+			l.Stop()
+			return nil, err
+		}
+
+		l.discoveryDone = make(chan struct{})
+		go l.pollTopics(admin, lc.topicPollInterval())
+	}
+
+	return l, nil
+}
+
+// Topics returns the topics the listener is consuming from.
+func (l *Listener) Topics() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	topics := make([]string, 0, len(l.subscriptions))
+	for topic := range l.subscriptions {
+		topics = append(topics, topic)
+	}
+
+	sort.Strings(topics)
+	return topics
+}
+
+// Stop cancels the context of the running handlers and gracefully stops
+// the nsq consumers, it blocks until all handlers have returned, including
+// the ones whose message was requeued on HandlerTimeout.
+func (l *Listener) Stop() {
+	l.cancel()
+	if l.discoveryDone != nil {
+		<-l.discoveryDone
+	}
+
+	l.mu.Lock()
+	subscriptions := l.subscriptions
+	l.subscriptions = make(map[string]*subscription)
+	l.mu.Unlock()
+
+	for _, s := range subscriptions {
+		s.consumer.Stop()
+	}
+
+	for _, s := range subscriptions {
+		<-s.consumer.StopChan
+		s.handler.stop()
+	}
+}
+
+// Pause stops receiving messages by setting RDY to 0 on every connection, then blocks
+// until the messages in flight are responded. Messages nsqd still delivers before RDY 0
+// takes effect are requeued without calling HandlerFunc. When PauseChannel is enabled the
+// channel is also paused in every nsqd known to nsqlookupd, pausing all of its consumers.
+func (l *Listener) Pause() error {
+	l.mu.Lock()
+	l.paused = true
+	handlers := l.handlers()
+	for _, h := range handlers {
+		h.setPaused(true)
+	}
+	l.changeMaxInFlight()
+	l.mu.Unlock()
+
+	l.logger.Info("listener paused", "channel", l.lc.Channel)
+
+	var err error
+	if l.lc.PauseChannel {
+		err = l.pauseChannel(true)
+	}
+
+	for _, h := range handlers {
+		h.waitIdle()
+	}
+
+	return err
+}
+
+// Resume restores RDY on every connection of a paused listener. When PauseChannel is
+// enabled the channel is unpaused in nsqd first, the listener stays paused if it fails.
+func (l *Listener) Resume() error {
+	if l.lc.PauseChannel {
+		if err := l.pauseChannel(false); err != nil {
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.paused = false
+	for _, h := range l.handlers() {
+		h.setPaused(false)
+	}
+	l.changeMaxInFlight()
+	l.logger.Info("listener resumed", "channel", l.lc.Channel)
+	return nil
+}
+
+// Paused reports whether the listener is paused.
+func (l *Listener) Paused() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.paused
+}
+
+// pauseChannel pauses, or unpauses, the listener channel of every topic in every
+// nsqd known to nsqlookupd.
+func (l *Listener) pauseChannel(pause bool) error {
+	nodes, err := l.admin.Nodes()
+	if err != nil {
+		return err
+	}
+
+	for _, topic := range l.Topics() {
+		for _, node := range nodes {
+			nsqd := l.admin.WithAddress(node.HTTPAddress())
+			if pause {
+				err = nsqd.PauseChannel(topic, l.lc.Channel)
+			} else {
+				err = nsqd.UnpauseChannel(topic, l.lc.Channel)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// handlers returns the handlers of the subscriptions, l.mu must be held.
+func (l *Listener) handlers() []*handler {
+	handlers := make([]*handler, 0, len(l.subscriptions)+len(l.connecting))
+	for _, s := range l.subscriptions {
+		handlers = append(handlers, s.handler)
+	}
+
+	for _, h := range l.connecting {
+		handlers = append(handlers, h)
+	}
+
+	return handlers
+}
+
+// changeMaxInFlight applies the max in flight of the listener state to the consumers,
+// l.mu must be held.
+func (l *Listener) changeMaxInFlight() {
+	maxInFlight := l.maxInFlight()
+	for _, s := range l.subscriptions {
+		s.consumer.ChangeMaxInFlight(maxInFlight)
+	}
+}
+
+// throttle lowers the max in flight of the consumers while the rate limiter is
+// throttling messages and restores it once it is not.
+func (l *Listener) throttle(throttled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.throttled = throttled
+	l.changeMaxInFlight()
+	l.logger.Debug("listener rate limit changed max in flight", "channel", l.lc.Channel, "throttled", throttled, "max_in_flight", l.maxInFlight())
+}
+
+// maxInFlight returns the max in flight of the consumers in the listener state, l.mu must be held.
+func (l *Listener) maxInFlight() int {
+	if l.paused {
+		return 0
+	}
+
+	if l.throttled {
+		return throttledMaxInFlight(l.lc.RateLimit, l.config.MaxInFlight, l.config.MsgTimeout)
+	}
+
+	return l.config.MaxInFlight
+}
+
+// subscribe starts consuming topic on the listener channel, topics already
+// consumed are skipped.
+func (l *Listener) subscribe(topic string) error {
+	lc := l.lc
+	lc.Topic = topic
+
+	// the handler is registered as connecting while the consumer queries nsqlookupd
+	// outside the lock, so that Pause reaches it and topic is not subscribed twice.
+	l.mu.Lock()
+	if _, ok := l.subscriptions[topic]; ok || l.connecting[topic] != nil || l.ctx.Err() != nil {
+		l.mu.Unlock()
+		return nil
+	}
+
+	handler := newHandler(l.ctx, lc)
+	handler.limiter = l.limiter
+	handler.setPaused(l.paused)
+	l.connecting[topic] = handler
+	maxInFlight := l.maxInFlight()
+	l.mu.Unlock()
+
+	consumer, err := l.connect(topic, handler, maxInFlight)
+
+	l.mu.Lock()
+	delete(l.connecting, topic)
 	if err != nil {
+		l.mu.Unlock()
 		return err
 	}
 
-	handler := handleMessage(lc)
-	consumer.AddConcurrentHandlers(handler, lc.HandlerConcurrency)
-	return consumer.ConnectToNSQLookupds(lc.Lookup)
+	if l.ctx.Err() != nil {
+		l.mu.Unlock()
+		consumer.Stop()
+		<-consumer.StopChan
+		handler.stop()
+		return nil
+	}
+
+	// the listener may have been paused or throttled while connecting
+	if current := l.maxInFlight(); current != maxInFlight {
+		consumer.ChangeMaxInFlight(current)
+	}
+
+	l.subscriptions[topic] = &subscription{consumer: consumer, handler: handler}
+	l.mu.Unlock()
+	return nil
+}
+
+// connect returns a consumer of topic delivering to handler, connected to nsqlookupd.
+func (l *Listener) connect(topic string, handler *handler, maxInFlight int) (*nsq.Consumer, error) {
+	consumer, err := nsq.NewConsumer(topic, l.lc.Channel, l.config)
+	if err != nil {
+		return nil, err
+	}
+
+	consumer.SetLogger(nsqLogger{l.logger}, l.lc.LogLevel.nsqLogLevel())
+	if maxInFlight != l.config.MaxInFlight {
+		consumer.ChangeMaxInFlight(maxInFlight)
+	}
+
+	consumer.AddConcurrentHandlers(handler, l.lc.HandlerConcurrency)
+	if err := consumer.ConnectToNSQLookupds(l.lc.Lookup); err != nil {
+		consumer.Stop()
+		return nil, err
+	}
+
+	return consumer, nil
 }
 
-func handleMessage(lc ListenerConfig) nsq.HandlerFunc {
-	return nsq.HandlerFunc(func(message *nsq.Message) error {
-		m := Message{Message: message}
-		if err := json.Unmarshal(message.Body, &m); err != nil {
+// ensureTopology creates the topic and channel on every nsqd known to nsqlookupd.
+func ensureTopology(admin *Admin, topic, channel string) error {
+	nodes, err := admin.Nodes()
+	if err != nil {
+		return err
+	}
+
+	for _, node := range nodes {
+		nsqd := admin.WithAddress(node.HTTPAddress())
+		if err := nsqd.CreateTopic(topic); err != nil {
 			return err
 		}
 
-		res, err := lc.HandlerFunc(&m)
-		if err != nil {
+		if err := nsqd.CreateChannel(topic, channel); err != nil {
 			return err
 		}
+	}
+
+	return nil
+}
+
+type handler struct {
+	ctx    context.Context
+	lc     ListenerConfig
+	tracer trace.Tracer
+	logger Logger
+
+	ordered *orderedQueue
+	batch   *batchQueue
+	limiter *rateLimiter
+
+	// running counts the HandlerFunc calls, including the ones still running after
+	// their message was requeued on HandlerTimeout.
+	running sync.WaitGroup
+
+	mu       sync.Mutex
+	emitters map[string]*Emitter
+
+	// inFlight counts the messages received and not yet responded, idle is
+	// signaled once it drops to zero. Messages received while paused are requeued.
+	inFlightMu sync.Mutex
+	inFlight   int
+	idle       *sync.Cond
+	paused     bool
+}
+
+func newHandler(ctx context.Context, lc ListenerConfig) *handler {
+	h := &handler{
+		ctx:      ctx,
+		lc:       lc,
+		tracer:   newTracer(lc.TracerProvider),
+		logger:   newLogger(lc.Logger, lc.LogLevel),
+		emitters: make(map[string]*Emitter),
+	}
+	h.idle = sync.NewCond(&h.inFlightMu)
+
+	if lc.BatchHandlerFunc != nil {
+		h.batch = newBatchQueue(h)
+	} else if lc.Ordered {
+		h.ordered = newOrderedQueue(h)
+	}
 
-		if m.ReplyTo == "" {
+	return h
+}
+
+// HandleMessage implements nsq.Handler, a non-nil error makes nsq requeue the message.
+func (h *handler) HandleMessage(message *nsq.Message) error {
+	if !h.received() {
+		message.DisableAutoResponse()
+		message.RequeueWithoutBackoff(0)
+		return nil
+	}
+
+	if h.batch != nil {
+		message.DisableAutoResponse()
+		h.batch.add(message)
+		return nil
+	}
+
+	if h.ordered != nil {
+		if key, seq := partitionOf(message.Body); key != "" {
+			message.DisableAutoResponse()
+			h.ordered.enqueue(key, seq, message)
 			return nil
 		}
+	}
+
+	defer h.responded()
+
+	err := h.handle(message)
+	h.lc.Metrics.observeRequeued(h.lc.Topic, h.lc.Channel, message, err)
+	return err
+}
+
+// finish finishes a message whose auto response is disabled.
+func (h *handler) finish(message *nsq.Message) {
+	message.Finish()
+	h.responded()
+}
+
+// requeue requeues a message whose auto response is disabled.
+func (h *handler) requeue(message *nsq.Message, delay time.Duration) {
+	message.Requeue(delay)
+	h.responded()
+}
+
+// received counts the message in flight, it reports false when the handler is paused,
+// which makes a concurrent waitIdle either wait for the message or see it rejected.
+func (h *handler) received() bool {
+	h.inFlightMu.Lock()
+	defer h.inFlightMu.Unlock()
+
+	if h.paused {
+		return false
+	}
+
+	h.inFlight++
+	return true
+}
+
+func (h *handler) setPaused(paused bool) {
+	h.inFlightMu.Lock()
+	defer h.inFlightMu.Unlock()
+
+	h.paused = paused
+}
+
+func (h *handler) responded() {
+	h.inFlightMu.Lock()
+	defer h.inFlightMu.Unlock()
+
+	h.inFlight--
+	if h.inFlight == 0 {
+		h.idle.Broadcast()
+	}
+}
+
+// waitIdle blocks until the messages in flight are responded.
+func (h *handler) waitIdle() {
+	h.inFlightMu.Lock()
+	defer h.inFlightMu.Unlock()
+
+	for h.inFlight > 0 {
+		h.idle.Wait()
+	}
+}
+
+func (h *handler) handle(message *nsq.Message) (err error) {
+	m := Message{Message: message, Topic: h.lc.Topic}
+	if err := json.Unmarshal(message.Body, &m); err != nil {
+		h.lc.Metrics.observeHandled(h.lc.Topic, h.lc.Channel, message.Attempts, 0, resultInvalid)
+		h.logger.Error("failed to decode message", h.fields(message, "error", err)...)
+		return err
+	}
+
+	spanCtx, span := startConsumerSpan(h.ctx, h.tracer, h.lc.Topic, h.lc.Channel, &m)
+	defer func() { endSpan(span, err) }()
+
+	if dup, err := h.processed(spanCtx, &m); err != nil || dup {
+		return err
+	}
 
-		emitter, err := NewEmitter(EmitterConfig{})
+	if m.ReplyTo != "" {
+		emitter, err := h.emitter(message.NSQDAddress)
 		if err != nil {
 			return err
 		}
+		m.replier = &replier{ctx: spanCtx, emitter: emitter, topic: m.ReplyTo}
+	}
+
+	if err := h.limiter.wait(spanCtx, 1); err != nil {
+		return err
+	}
+
+	ctx, cancel := h.context(spanCtx)
+	defer cancel()
+
+	start := time.Now()
+	stop := h.touch(message)
+	res, err := h.call(ctx, &m)
+	stop()
+	h.lc.Metrics.observeHandled(h.lc.Topic, h.lc.Channel, message.Attempts, time.Since(start), resultOf(err))
+	if err == nil {
+		h.markProcessed(spanCtx, &m)
+	}
+	if m.replier == nil {
+		return err
+	}
+
+	if err == nil {
+		return m.replier.send(res, nil, true)
+	}
+
+	// the listener is stopping, the request is requeued instead of answered with the cancellation
+	if h.ctx.Err() != nil {
+		return err
+	}
+
+	if rerr := m.replier.send(nil, newRemoteError(err), true); rerr != nil {
+		return rerr
+	}
+
+	if h.lc.RequeueOnErrorReply {
+		return err
+	}
+
+	return nil
+}
+
+// processed reports whether m, identified by its IdempotencyKey or UUID, was already
+// processed on the listener channel according to the Deduplicator,
+// duplicates are finished.
+func (h *handler) processed(ctx context.Context, m *Message) (bool, error) {
+	key := h.dedupKey(m)
+	if key == "" {
+		return false, nil
+	}
+
+	dup, err := h.lc.Deduplicator.Processed(ctx, key)
+	if err != nil {
+		h.logger.Error("failed to check duplicate message", h.fields(m.Message, "dedup_key", key, "error", err)...)
+		return false, err
+	}
+
+	if dup {
+		h.lc.Metrics.observeHandled(h.lc.Topic, h.lc.Channel, m.Attempts, 0, resultDuplicate)
+		h.logger.Debug("skipped duplicate message", h.fields(m.Message, "dedup_key", key)...)
+	}
+
+	return dup, nil
+}
+
+func (h *handler) markProcessed(ctx context.Context, m *Message) {
+	key := h.dedupKey(m)
+	if key == "" {
+		return
+	}
+
+	if err := h.lc.Deduplicator.MarkProcessed(ctx, key); err != nil {
+		h.logger.Error("failed to mark message processed", h.fields(m.Message, "dedup_key", key, "error", err)...)
+	}
+}
+
+// dedupKey returns the key of m passed to the Deduplicator, scoped by the listener channel
+// so channels sharing a Deduplicator each process the message. It is empty without Deduplicator.
+func (h *handler) dedupKey(m *Message) string {
+	if h.lc.Deduplicator == nil || m.dedupKey() == "" {
+		return ""
+	}
+
+	return h.lc.Channel + ":" + m.dedupKey()
+}
+
+// LogFailedMessage implements nsq.FailedMessageLogger, it is called by nsq once
+// the message exceeded MaxAttempts and publishes it to DeadLetterTopic if configured.
+func (h *handler) LogFailedMessage(message *nsq.Message) {
+	if h.lc.DeadLetterTopic == "" {
+		return
+	}
+
+	emitter, err := h.emitter(message.NSQDAddress)
+	if err != nil {
+		h.logger.Error("failed to create dead letter emitter", h.fields(message, "error", err)...)
+		return
+	}
+
+	if err := emitter.publish(h.ctx, h.lc.DeadLetterTopic, message.Body); err != nil {
+		h.logger.Error("failed to dead letter message", h.fields(message, "dead_letter_topic", h.lc.DeadLetterTopic, "error", err)...)
+		return
+	}
+
+	h.lc.Metrics.observeDeadLettered(h.lc.Topic, h.lc.Channel, h.lc.DeadLetterTopic)
+	h.logger.Warn("message dead lettered", h.fields(message, "dead_letter_topic", h.lc.DeadLetterTopic)...)
+}
+
+// emitter returns ListenerConfig.Emitter if set, otherwise a shared emitter publishing
+// to the nsqd the message was received from, built from the listener settings.
+func (h *handler) emitter(address string) (*Emitter, error) {
+	if h.lc.Emitter != nil {
+		return h.lc.Emitter, nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if emitter, ok := h.emitters[address]; ok {
+		return emitter, nil
+	}
+
+	emitter, err := NewEmitter(newReplyEmitterConfig(h.lc, address))
+	if err != nil {
+		return nil, err
+	}
+
+	h.emitters[address] = emitter
+	return emitter, nil
+}
+
+// fields returns the structured fields identifying message followed by keyvals.
+func (h *handler) fields(message *nsq.Message, keyvals ...interface{}) []interface{} {
+	return append([]interface{}{
+		"topic", h.lc.Topic,
+		"channel", h.lc.Channel,
+		"message_id", string(message.ID[:]),
+		"attempts", message.Attempts,
+	}, keyvals...)
+}
+
+func (h *handler) stop() {
+	if h.batch != nil {
+		h.batch.wait()
+	}
+	h.running.Wait()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for address, emitter := range h.emitters {
+		emitter.Stop()
+		delete(h.emitters, address)
+	}
+}
+
+func (h *handler) touch(message *nsq.Message) (stop func()) {
+	if !h.lc.AutoTouch {
+		return func() {}
+	}
+
+	interval := h.lc.MsgTimeout / 2
+	if interval <= 0 {
+		interval = defaultMsgTimeout / 2
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var deadline <-chan time.Time
+		if h.lc.MaxProcessingTime > 0 {
+			timer := time.NewTimer(h.lc.MaxProcessingTime)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-deadline:
+				return
+			case <-ticker.C:
+				message.Touch()
+			}
+		}
+	}()
 
-		return emitter.Emit(m.ReplyTo, res)
-	})
+	return func() { close(done) }
+}
+
+// context returns the context passed to HandlerFunc, its deadline is HandlerTimeout,
+// or MaxProcessingTime when AutoTouch is enabled, falling back to MsgTimeout.
+func (h *handler) context(parent context.Context) (context.Context, context.CancelFunc) {
+	timeout := h.lc.HandlerTimeout
+	if timeout == 0 && h.lc.AutoTouch {
+		timeout = h.lc.MaxProcessingTime
+		if timeout == 0 {
+			return context.WithCancel(parent)
+		}
+	}
+
+	if timeout == 0 {
+		timeout = h.lc.MsgTimeout
+	}
+
+	if timeout == 0 {
+		timeout = defaultMsgTimeout
+	}
+
+	return context.WithTimeout(parent, timeout)
+}
+
+type result struct {
+	res interface{}
+	err error
+}
+
+// call runs HandlerFunc, returning the context error if its deadline is exceeded
+// or the listener is stopped before it returns, so the message is requeued.
+func (h *handler) call(ctx context.Context, m *Message) (interface{}, error) {
+	done := make(chan result, 1)
+	h.running.Add(1)
+	go func() {
+		defer h.running.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				perr := &PanicError{Value: r, Stack: debug.Stack()}
+				h.logger.Error("handler panicked", h.fields(m.Message, "panic", r, "stack", string(perr.Stack))...)
+				if h.lc.OnPanic != nil {
+					h.lc.OnPanic(m, perr)
+				}
+				done <- result{err: perr}
+			}
+		}()
+
+		res, err := h.lc.HandlerFunc(ctx, m)
+		done <- result{res, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.res, r.err
+	case <-ctx.Done():
+		h.logger.Warn("handler did not return before its context was done", h.fields(m.Message, "error", ctx.Err())...)
+		return nil, ctx.Err()
+	}
 }
@@ -1,11 +1,19 @@
 package bus
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	nsq "github.com/nsqio/go-nsq"
 )
 
 func TestListener(t *testing.T) {
@@ -23,6 +31,62 @@ func TestListener(t *testing.T) {
 			"listener on validation",
 			testOnValidation,
 		},
+		{
+			"ensure topology",
+			testEnsureTopology,
+		},
+		{
+			"topic discovery",
+			testListenerTopicDiscovery,
+		},
+		{
+			"topic matching",
+			testListenerTopicMatch,
+		},
+		{
+			"pause and resume",
+			testListenerPause,
+		},
+		{
+			"pause waits for messages in flight",
+			testListenerPauseInFlight,
+		},
+		{
+			"no message handled after pause",
+			testListenerPauseGate,
+		},
+		{
+			"subscribe connects outside the lock",
+			testListenerSubscribeConnecting,
+		},
+		{
+			"pause channel failure",
+			testListenerPauseChannelError,
+		},
+		{
+			"handler message topic",
+			testHandlerMessageTopic,
+		},
+		{
+			"handler panic recovery",
+			testHandlerPanicRecovery,
+		},
+		{
+			"handler auto touch",
+			testHandlerAutoTouch,
+		},
+		{
+			"handler timeout",
+			testHandlerTimeout,
+		},
+		{
+			"handler requeues requests on stop",
+			testHandlerRequestStop,
+		},
+		{
+			"handler reply emitter",
+			testHandlerReplyEmitter,
+		},
 	}
 
 	for _, test := range tests {
@@ -47,7 +111,7 @@ func testOn(t *testing.T) {
 
 	var wg sync.WaitGroup
 	wg.Add(1)
-	handler := func(message *Message) (reply interface{}, err error) {
+	handler := func(ctx context.Context, message *Message) (reply interface{}, err error) {
 		defer wg.Done()
 		e := event{}
 		if err = message.DecodePayload(&e); err != nil {
@@ -113,7 +177,7 @@ func testOnValidation(t *testing.T) {
 			ListenerConfig{
 				Topic:   "",
 				Channel: "test_on",
-				HandlerFunc: func(message *Message) (reply interface{}, err error) {
+				HandlerFunc: func(ctx context.Context, message *Message) (reply interface{}, err error) {
 					return
 				},
 			},
@@ -123,7 +187,7 @@ func testOnValidation(t *testing.T) {
 			ListenerConfig{
 				Topic:   "ltopic",
 				Channel: "",
-				HandlerFunc: func(message *Message) (reply interface{}, err error) {
+				HandlerFunc: func(ctx context.Context, message *Message) (reply interface{}, err error) {
 					return
 				},
 			},
@@ -135,11 +199,593 @@ func testOnValidation(t *testing.T) {
 				Channel: "test_on",
 			},
 		},
+		{
+			"unexpected topic pattern",
+			ListenerConfig{
+				TopicPattern: "orders.[",
+				Channel:      "test_on",
+				HandlerFunc: func(ctx context.Context, message *Message) (reply interface{}, err error) {
+					return
+				},
+			},
+		},
 	}
 
 	for _, c := range cases {
 		if err := On(c.config); err == nil {
-			t.Fatalf(fmt.Sprintf("%s: %v", c.msg, err))
+			t.Fatalf("%s: %v", c.msg, err)
+		}
+	}
+}
+
+func testEnsureTopology(t *testing.T) {
+	var requests []string
+	nsqd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path+"?"+r.URL.RawQuery)
+	}))
+	defer nsqd.Close()
+
+	lookupd := newLookupdMock(t, serverAddress(nsqd))
+	defer lookupd.Close()
+
+	admin := NewAdmin(AdminConfig{Lookup: []string{serverAddress(lookupd)}})
+	if err := ensureTopology(admin, "ltopic", "test_on"); err != nil {
+		t.Fatalf("expected to ensure topology %v", err)
+	}
+
+	expected := []string{
+		"/topic/create?topic=ltopic",
+		"/channel/create?channel=test_on&topic=ltopic",
+	}
+
+	if fmt.Sprint(requests) != fmt.Sprint(expected) {
+		t.Errorf("unexpected requests %v", requests)
+	}
+}
+
+func testListenerTopicDiscovery(t *testing.T) {
+	lookupd := newTopicsLookupdMock(
+		[]string{"orders.a", "users"},
+		[]string{"orders.a", "orders.b", "users", "payments"},
+	)
+	defer lookupd.Close()
+
+	l, err := NewListener(ListenerConfig{
+		Topics:            []string{"payments"},
+		TopicPattern:      "orders.*",
+		Channel:           "billing",
+		Lookup:            []string{serverAddress(lookupd)},
+		TopicPollInterval: time.Millisecond * 10,
+		Logger:            &loggerMock{},
+		HandlerFunc: func(ctx context.Context, message *Message) (reply interface{}, err error) {
+			return
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected to create listener %v", err)
+	}
+
+	if topics := fmt.Sprint(l.Topics()); topics != "[orders.a payments]" {
+		t.Errorf("unexpected initial topics %v", topics)
+	}
+
+	deadline := time.Now().Add(time.Second * 2)
+	for fmt.Sprint(l.Topics()) != "[orders.a orders.b payments]" {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected orders.b to be discovered, got %v", l.Topics())
 		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	l.Stop()
+	if topics := l.Topics(); len(topics) != 0 {
+		t.Errorf("expected stopped listener to have no topics %v", topics)
 	}
 }
+
+func testListenerTopicMatch(t *testing.T) {
+	lc := ListenerConfig{
+		Topic:        "payments",
+		Topics:       []string{"refunds", "payments", ""},
+		TopicPattern: "orders.*",
+		TopicRegexp:  regexp.MustCompile(`^users\.(created|deleted)$`),
+	}
+
+	if topics := fmt.Sprint(lc.topics()); topics != "[payments refunds]" {
+		t.Errorf("unexpected topics %v", topics)
+	}
+
+	cases := []struct {
+		topic string
+		match bool
+	}{
+		{"orders.p0", true},
+		{"orders", false},
+		{"users.created", true},
+		{"users.updated", false},
+		{"payments", false},
+	}
+
+	for _, c := range cases {
+		if match := lc.matchTopic(c.topic); match != c.match {
+			t.Errorf("%s: expected match to be %v", c.topic, c.match)
+		}
+	}
+}
+
+func testListenerPause(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	nsqd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.URL.Path+"?"+r.URL.RawQuery)
+	}))
+	defer nsqd.Close()
+
+	lookupd := newLookupdMock(t, serverAddress(nsqd))
+	defer lookupd.Close()
+
+	l := newPausableListener(t, ListenerConfig{
+		Lookup:       []string{serverAddress(lookupd)},
+		PauseChannel: true,
+	})
+	defer l.Stop()
+
+	if l.Paused() {
+		t.Fatal("expected new listener not to be paused")
+	}
+
+	if err := l.Pause(); err != nil {
+		t.Fatalf("expected to pause listener %v", err)
+	}
+
+	if !l.Paused() || l.currentMaxInFlight() != 0 {
+		t.Errorf("expected paused listener to have no max in flight, got %d", l.currentMaxInFlight())
+	}
+
+	if err := l.Resume(); err != nil {
+		t.Fatalf("expected to resume listener %v", err)
+	}
+
+	if l.Paused() || l.currentMaxInFlight() != 10 {
+		t.Errorf("expected resumed listener to restore max in flight, got %d", l.currentMaxInFlight())
+	}
+
+	expected := []string{
+		"/channel/pause?channel=billing&topic=orders",
+		"/channel/unpause?channel=billing&topic=orders",
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(requests) != fmt.Sprint(expected) {
+		t.Errorf("unexpected requests %v", requests)
+	}
+}
+
+func testListenerPauseInFlight(t *testing.T) {
+	lookupd := newLookupdMock(t)
+	defer lookupd.Close()
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	l := newPausableListener(t, ListenerConfig{
+		Lookup: []string{serverAddress(lookupd)},
+		HandlerFunc: func(ctx context.Context, message *Message) (reply interface{}, err error) {
+			close(started)
+			<-release
+			return
+		},
+	})
+	defer l.Stop()
+
+	h := l.subscriptions["orders"].handler
+	go h.HandleMessage(newNSQMessage(t, NewMessage([]byte(`{}`), "")))
+	<-started
+
+	paused := make(chan error)
+	go func() { paused <- l.Pause() }()
+
+	select {
+	case <-paused:
+		t.Fatal("expected pause to wait for the message in flight")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	close(release)
+	select {
+	case err := <-paused:
+		if err != nil {
+			t.Errorf("expected to pause listener %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected pause to return once the message is responded")
+	}
+}
+
+func testListenerPauseGate(t *testing.T) {
+	lookupd := newLookupdMock(t)
+	defer lookupd.Close()
+
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	l := newPausableListener(t, ListenerConfig{
+		Lookup: []string{serverAddress(lookupd)},
+		HandlerFunc: func(ctx context.Context, message *Message) (reply interface{}, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			return
+		},
+	})
+	defer l.Stop()
+
+	if err := l.Pause(); err != nil {
+		t.Fatalf("expected to pause listener %v", err)
+	}
+
+	// nsqd keeps delivering up to the last RDY count until RDY 0 is sent
+	h := l.subscriptions["orders"].handler
+	delegate := &messageDelegateMock{}
+	for i := 0; i < 3; i++ {
+		message := newNSQMessage(t, NewMessage([]byte(`{}`), ""))
+		message.Delegate = delegate
+		if err := h.HandleMessage(message); err != nil {
+			t.Fatalf("expected paused handler to requeue message %v", err)
+		}
+	}
+
+	mu.Lock()
+	if calls != 0 {
+		t.Errorf("expected no HandlerFunc call after Pause returned, got %d", calls)
+	}
+	mu.Unlock()
+
+	if delegate.requeued != 3 {
+		t.Errorf("expected messages received while paused to be requeued, got %d", delegate.requeued)
+	}
+
+	if err := l.Resume(); err != nil {
+		t.Fatalf("expected to resume listener %v", err)
+	}
+
+	if err := h.HandleMessage(newNSQMessage(t, NewMessage([]byte(`{}`), ""))); err != nil {
+		t.Fatalf("expected to handle message %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("expected resumed listener to call HandlerFunc, got %d", calls)
+	}
+}
+
+func testListenerPauseChannelError(t *testing.T) {
+	lookupd := newLookupdMock(t)
+	defer lookupd.Close()
+
+	l := newPausableListener(t, ListenerConfig{
+		Lookup:       []string{serverAddress(lookupd)},
+		Admin:        NewAdmin(AdminConfig{Lookup: []string{"127.0.0.1:1"}}),
+		PauseChannel: true,
+	})
+	defer l.Stop()
+
+	if err := l.Pause(); err == nil {
+		t.Error("expected pause to fail when nsqlookupd is unreachable")
+	}
+
+	if !l.Paused() {
+		t.Error("expected listener to be paused locally")
+	}
+
+	if err := l.Resume(); err == nil {
+		t.Error("expected resume to fail when nsqlookupd is unreachable")
+	}
+
+	if !l.Paused() {
+		t.Error("expected listener to stay paused")
+	}
+}
+
+func testListenerSubscribeConnecting(t *testing.T) {
+	querying := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("topic") == "invoices" {
+			once.Do(func() { close(querying) })
+			<-release
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer lookupd.Close()
+
+	l := newPausableListener(t, ListenerConfig{Lookup: []string{serverAddress(lookupd)}})
+	defer l.Stop()
+
+	subscribed := make(chan error, 2)
+	go func() { subscribed <- l.subscribe("invoices") }()
+	<-querying
+	go func() { subscribed <- l.subscribe("invoices") }()
+
+	paused := make(chan error)
+	go func() { paused <- l.Pause() }()
+
+	select {
+	case err := <-paused:
+		if err != nil {
+			t.Fatalf("expected to pause listener %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected pause not to wait for nsqlookupd")
+	}
+
+	if err := <-subscribed; err != nil {
+		t.Errorf("expected concurrent subscribe to be skipped %v", err)
+	}
+
+	if topics := l.Topics(); fmt.Sprint(topics) != "[orders]" {
+		t.Errorf("expected connecting topic not to be listed %v", topics)
+	}
+
+	close(release)
+	if err := <-subscribed; err != nil {
+		t.Fatalf("expected to subscribe %v", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.subscriptions) != 2 || len(l.connecting) != 0 {
+		t.Fatalf("unexpected subscriptions %v", l.subscriptions)
+	}
+
+	if l.subscriptions["invoices"].handler.received() {
+		t.Error("expected handler subscribed while pausing to be paused")
+	}
+}
+
+func newPausableListener(t *testing.T, lc ListenerConfig) *Listener {
+	lc.Topic = "orders"
+	lc.Channel = "billing"
+	lc.MaxInFlight = 10
+	lc.Logger = &loggerMock{}
+	if lc.HandlerFunc == nil {
+		lc.HandlerFunc = func(ctx context.Context, message *Message) (reply interface{}, err error) {
+			return
+		}
+	}
+
+	l, err := NewListener(lc)
+	if err != nil {
+		t.Fatalf("expected to create listener %v", err)
+	}
+
+	return l
+}
+
+func testHandlerMessageTopic(t *testing.T) {
+	var topic string
+	h := newHandler(context.Background(), ListenerConfig{
+		Topic: "orders.p1",
+		HandlerFunc: func(ctx context.Context, message *Message) (reply interface{}, err error) {
+			topic = message.Topic
+			return
+		},
+	})
+
+	if err := h.HandleMessage(newNSQMessage(t, NewMessage([]byte(`{}`), ""))); err != nil {
+		t.Fatalf("expected to handle message %v", err)
+	}
+
+	if topic != "orders.p1" {
+		t.Errorf("expected message topic to be orders.p1, got %q", topic)
+	}
+}
+
+func testHandlerPanicRecovery(t *testing.T) {
+	var recovered *PanicError
+	h := newHandler(context.Background(), ListenerConfig{
+		HandlerFunc: func(ctx context.Context, message *Message) (reply interface{}, err error) {
+			panic("boom")
+		},
+		OnPanic: func(m *Message, err *PanicError) {
+			recovered = err
+		},
+	})
+
+	err := h.HandleMessage(newNSQMessage(t, NewMessage([]byte(`{}`), "")))
+	perr, ok := err.(*PanicError)
+	if !ok {
+		t.Fatalf("expected panic error, got %v", err)
+	}
+
+	if perr.Value != "boom" {
+		t.Errorf("unexpected panic value %v", perr.Value)
+	}
+
+	if len(perr.Stack) == 0 {
+		t.Error("expected panic error to carry the stack trace")
+	}
+
+	if recovered != perr {
+		t.Error("expected OnPanic to be called with the panic error")
+	}
+}
+
+func testHandlerAutoTouch(t *testing.T) {
+	cases := []struct {
+		msg               string
+		autoTouch         bool
+		maxProcessingTime time.Duration
+		minTouches        int
+		maxTouches        int
+	}{
+		{"disabled", false, 0, 0, 0},
+		{"until handler returns", true, 0, 2, 10},
+		{"bounded by max processing time", true, time.Millisecond * 50, 1, 2},
+	}
+
+	for _, c := range cases {
+		h := newHandler(context.Background(), ListenerConfig{
+			MsgTimeout:        time.Millisecond * 40,
+			AutoTouch:         c.autoTouch,
+			MaxProcessingTime: c.maxProcessingTime,
+			HandlerTimeout:    time.Second,
+			HandlerFunc: func(ctx context.Context, message *Message) (reply interface{}, err error) {
+				time.Sleep(time.Millisecond * 90)
+				return
+			},
+		})
+
+		message := newNSQMessage(t, NewMessage([]byte(`{}`), ""))
+		if err := h.HandleMessage(message); err != nil {
+			t.Fatalf("%s: expected to handle message %v", c.msg, err)
+		}
+
+		d := message.Delegate.(*messageDelegateMock)
+		d.mu.Lock()
+		touched := d.touched
+		d.mu.Unlock()
+		if touched < c.minTouches || touched > c.maxTouches {
+			t.Errorf("%s: unexpected touches %d", c.msg, touched)
+		}
+	}
+}
+
+func testHandlerTimeout(t *testing.T) {
+	h := newHandler(context.Background(), ListenerConfig{
+		HandlerTimeout: time.Millisecond * 20,
+		HandlerFunc: func(ctx context.Context, message *Message) (reply interface{}, err error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+
+	if err := h.HandleMessage(newNSQMessage(t, NewMessage([]byte(`{}`), ""))); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error value %v", err)
+	}
+
+	var returned int32
+	ctx, cancel := context.WithCancel(context.Background())
+	h = newHandler(ctx, ListenerConfig{
+		HandlerFunc: func(ctx context.Context, message *Message) (reply interface{}, err error) {
+			time.Sleep(time.Millisecond * 100)
+			atomic.StoreInt32(&returned, 1)
+			return
+		},
+	})
+
+	time.AfterFunc(time.Millisecond*20, cancel)
+	if err := h.HandleMessage(newNSQMessage(t, NewMessage([]byte(`{}`), ""))); err != context.Canceled {
+		t.Fatalf("unexpected error value %v", err)
+	}
+
+	h.stop()
+	if atomic.LoadInt32(&returned) != 1 {
+		t.Error("expected stop to wait for the handler still running")
+	}
+}
+
+func testHandlerRequestStop(t *testing.T) {
+	nsqd := newNSQDMock(t)
+	defer nsqd.Close()
+	emitter, err := NewEmitter(EmitterConfig{Address: nsqd.address, LogLevel: LogError})
+	if err != nil {
+		t.Fatalf("expected to initialize emitter %v", err)
+	}
+	defer emitter.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := newHandler(ctx, ListenerConfig{
+		Emitter: emitter,
+		HandlerFunc: func(ctx context.Context, message *Message) (reply interface{}, err error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+
+	m := NewMessage([]byte(`{}`), "")
+	m.ReplyTo = "reply.ephemeral"
+	time.AfterFunc(time.Millisecond*20, cancel)
+	if err := h.HandleMessage(newNSQMessage(t, m)); err != context.Canceled {
+		t.Fatalf("expected request to be requeued, got %v", err)
+	}
+
+	if published := nsqd.published(); published != 0 {
+		t.Errorf("expected no error reply on stop, got %d publishes", published)
+	}
+}
+
+func testHandlerReplyEmitter(t *testing.T) {
+	h := newHandler(context.Background(), ListenerConfig{})
+	defer h.stop()
+
+	e1, err := h.emitter("localhost:4150")
+	if err != nil {
+		t.Fatalf("expected to create reply emitter %v", err)
+	}
+
+	e2, err := h.emitter("localhost:4150")
+	if err != nil {
+		t.Fatalf("expected to create reply emitter %v", err)
+	}
+
+	if e1 != e2 {
+		t.Error("expected reply emitter to be shared")
+	}
+
+	emitter, err := NewEmitter(EmitterConfig{})
+	if err != nil {
+		t.Fatalf("expected to initialize emitter %v", err)
+	}
+	defer emitter.Stop()
+
+	h = newHandler(context.Background(), ListenerConfig{Emitter: emitter})
+	if e, _ := h.emitter("localhost:4150"); e != emitter {
+		t.Error("expected configured reply emitter to be used")
+	}
+}
+
+func newNSQMessage(t *testing.T, m *Message) *nsq.Message {
+	body, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("expected to marshal message %v", err)
+	}
+
+	var id nsq.MessageID
+	copy(id[:], "0123456789abcdef")
+	message := nsq.NewMessage(id, body)
+	message.Delegate = &messageDelegateMock{}
+	return message
+}
+
+type messageDelegateMock struct {
+	mu       sync.Mutex
+	finished int
+	requeued int
+	touched  int
+}
+
+func (d *messageDelegateMock) OnFinish(m *nsq.Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.finished++
+}
+
+func (d *messageDelegateMock) OnRequeue(m *nsq.Message, delay time.Duration, backoff bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.requeued++
+}
+
+func (d *messageDelegateMock) OnTouch(m *nsq.Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.touched++
+}
@@ -0,0 +1,133 @@
+package bus
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+// Logger logs bus and nsq events with structured fields, keyvals are alternating
+// keys and values. *slog.Logger satisfies Logger, zap and zerolog adapters are
+// provided by the zaplogger and zerologger packages.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// LogLevel is the minimum level of the logged events, defaults to LogInfo.
+type LogLevel int
+
+// Log levels.
+const (
+	LogDebug LogLevel = iota - 1
+	LogInfo
+	LogWarn
+	LogError
+)
+
+// newLogger returns l, or a Logger writing to the standard logger when nil,
+// discarding the events below level.
+func newLogger(l Logger, level LogLevel) Logger {
+	if l == nil {
+		l = stdLogger{}
+	}
+
+	return leveledLogger{Logger: l, level: level}
+}
+
+// NewStdLogger returns the Logger used when none is configured, it writes events
+// to the standard logger as "LEVEL msg key=value ...".
+func NewStdLogger() Logger {
+	return stdLogger{}
+}
+
+// nsqLogLevel returns the go-nsq log level matching l.
+func (l LogLevel) nsqLogLevel() nsq.LogLevel {
+	switch {
+	case l <= LogDebug:
+		return nsq.LogLevelDebug
+	case l == LogInfo:
+		return nsq.LogLevelInfo
+	case l == LogWarn:
+		return nsq.LogLevelWarning
+	}
+
+	return nsq.LogLevelError
+}
+
+type leveledLogger struct {
+	Logger
+	level LogLevel
+}
+
+func (l leveledLogger) Debug(msg string, keyvals ...interface{}) {
+	if l.level <= LogDebug {
+		l.Logger.Debug(msg, keyvals...)
+	}
+}
+
+func (l leveledLogger) Info(msg string, keyvals ...interface{}) {
+	if l.level <= LogInfo {
+		l.Logger.Info(msg, keyvals...)
+	}
+}
+
+func (l leveledLogger) Warn(msg string, keyvals ...interface{}) {
+	if l.level <= LogWarn {
+		l.Logger.Warn(msg, keyvals...)
+	}
+}
+
+// stdLogger writes events to the standard logger as "LEVEL msg key=value ...".
+type stdLogger struct{}
+
+func (stdLogger) Debug(msg string, keyvals ...interface{}) { stdLog("DBG", msg, keyvals) }
+func (stdLogger) Info(msg string, keyvals ...interface{})  { stdLog("INF", msg, keyvals) }
+func (stdLogger) Warn(msg string, keyvals ...interface{})  { stdLog("WRN", msg, keyvals) }
+func (stdLogger) Error(msg string, keyvals ...interface{}) { stdLog("ERR", msg, keyvals) }
+
+func stdLog(level, msg string, keyvals []interface{}) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		var v interface{} = "(MISSING)"
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+		fmt.Fprintf(&b, " %v=%v", keyvals[i], v)
+	}
+
+	log.Output(3, b.String())
+}
+
+// nsqLogger adapts Logger to the logger expected by go-nsq SetLogger, go-nsq
+// lines are prefixed by their level, e.g. "INF    1 [topic/channel] connecting".
+type nsqLogger struct {
+	logger Logger
+}
+
+func (l nsqLogger) Output(calldepth int, s string) error {
+	level, msg := s, ""
+	if len(s) > 3 {
+		level, msg = s[:3], strings.TrimSpace(s[3:])
+	}
+
+	switch level {
+	case nsq.LogLevelDebug.String():
+		l.logger.Debug(msg, "component", "nsq")
+	case nsq.LogLevelInfo.String():
+		l.logger.Info(msg, "component", "nsq")
+	case nsq.LogLevelWarning.String():
+		l.logger.Warn(msg, "component", "nsq")
+	default:
+		l.logger.Error(msg, "component", "nsq")
+	}
+
+	return nil
+}
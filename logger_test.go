@@ -0,0 +1,129 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"testing"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+var _ Logger = (*slog.Logger)(nil)
+
+func TestLogger(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		scenario string
+		function func(*testing.T)
+	}{
+		{
+			"log level",
+			testLoggerLevel,
+		},
+		{
+			"nsq logger",
+			testNSQLogger,
+		},
+		{
+			"handler fields",
+			testLoggerHandlerFields,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			test.function(t)
+		})
+	}
+}
+
+func testLoggerLevel(t *testing.T) {
+	cases := []struct {
+		level    LogLevel
+		expected string
+	}{
+		{LogDebug, "[DBG debug INF info WRN warn ERR error]"},
+		{LogInfo, "[INF info WRN warn ERR error]"},
+		{LogWarn, "[WRN warn ERR error]"},
+		{LogError, "[ERR error]"},
+	}
+
+	for _, c := range cases {
+		recorder := &loggerMock{}
+		logger := newLogger(recorder, c.level)
+		logger.Debug("debug")
+		logger.Info("info")
+		logger.Warn("warn")
+		logger.Error("error")
+
+		if fmt.Sprint(recorder.entries()) != c.expected {
+			t.Errorf("level %d: unexpected entries %v", c.level, recorder.entries())
+		}
+	}
+
+	if LogLevel(0) != LogInfo || LogWarn.nsqLogLevel() != nsq.LogLevelWarning || LogDebug.nsqLogLevel() != nsq.LogLevelDebug {
+		t.Error("unexpected log levels")
+	}
+}
+
+func testNSQLogger(t *testing.T) {
+	recorder := &loggerMock{}
+	logger := nsqLogger{recorder}
+	logger.Output(2, "INF    1 [orders/billing] querying nsqlookupd")
+	logger.Output(2, "WRN    1 (127.0.0.1:4150) backing off")
+	logger.Output(2, "ERR    1 (127.0.0.1:4150) IO error")
+	logger.Output(2, "DBG    1 connecting")
+
+	expected := "[INF 1 [orders/billing] querying nsqlookupd WRN 1 (127.0.0.1:4150) backing off ERR 1 (127.0.0.1:4150) IO error DBG 1 connecting]"
+	if fmt.Sprint(recorder.entries()) != expected {
+		t.Errorf("unexpected entries %v", recorder.entries())
+	}
+}
+
+func testLoggerHandlerFields(t *testing.T) {
+	recorder := &loggerMock{}
+	h := newHandler(context.Background(), ListenerConfig{Topic: "orders", Channel: "billing", Logger: recorder})
+
+	message := newNSQMessage(t, NewMessage([]byte(`"event"`), ""))
+	message.Body = []byte("invalid")
+	message.Attempts = 2
+	h.HandleMessage(message)
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if len(recorder.keyvals) != 1 {
+		t.Fatalf("unexpected entries %v", recorder.msgs)
+	}
+
+	fields := fmt.Sprint(recorder.keyvals[0][:8])
+	if fields != "[topic orders channel billing message_id 0123456789abcdef attempts 2]" {
+		t.Errorf("unexpected fields %v", fields)
+	}
+}
+
+type loggerMock struct {
+	mu      sync.Mutex
+	msgs    []string
+	keyvals [][]interface{}
+}
+
+func (l *loggerMock) Debug(msg string, keyvals ...interface{}) { l.log("DBG", msg, keyvals) }
+func (l *loggerMock) Info(msg string, keyvals ...interface{})  { l.log("INF", msg, keyvals) }
+func (l *loggerMock) Warn(msg string, keyvals ...interface{})  { l.log("WRN", msg, keyvals) }
+func (l *loggerMock) Error(msg string, keyvals ...interface{}) { l.log("ERR", msg, keyvals) }
+
+func (l *loggerMock) log(level, msg string, keyvals []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, level, msg)
+	l.keyvals = append(l.keyvals, keyvals)
+}
+
+func (l *loggerMock) entries() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.msgs...)
+}
@@ -1,7 +1,9 @@
 package bus
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 
 	nsq "github.com/nsqio/go-nsq"
 )
@@ -11,17 +13,92 @@ import (
 type (
 	Message struct {
 		*nsq.Message
-		ReplyTo string
-		Payload []byte
+		// Topic is the topic the message was received from, it is set by listeners.
+		Topic string `json:"-"`
+		// UUID identifies the message across redeliveries, unlike the nsq message ID
+		// which changes when the message is published again.
+		UUID string `json:",omitempty"`
+		// Type names the payload, it defaults to the package qualified name of the payload
+		// Go type, see TypeName, and is set explicitly WithType, Router dispatches messages by Type.
+		Type string `json:",omitempty"`
+		// IdempotencyKey is set by WithIdempotencyKey, messages sharing the same key
+		// are collapsed by listeners with a Deduplicator.
+		IdempotencyKey string `json:",omitempty"`
+		// PartitionKey is set by WithPartitionKey, PartitionSeq is the position of the
+		// message among the messages of the key emitted by the same emitter.
+		PartitionKey string `json:",omitempty"`
+		PartitionSeq uint64 `json:",omitempty"`
+		ReplyTo      string
+		Payload      []byte
+		Error        *RemoteError `json:",omitempty"`
+		Hostname     string       `json:",omitempty"`
+		ClientID     string       `json:",omitempty"`
+		// Seq is the position of a reply within a reply stream.
+		Seq int `json:",omitempty"`
+		// EOS marks the last reply of a reply stream.
+		EOS bool `json:",omitempty"`
+		// Headers carries the trace context of the producer span.
+		Headers map[string]string `json:",omitempty"`
+
+		replier *replier
+	}
+
+	// RemoteError carries the error returned by the HandlerFunc of a responder
+	// back to the requester.
+	RemoteError struct {
+		Code    string
+		Message string
 	}
 )
 
-// NewMessage returns a new bus.Message.
+// Error codes set on RemoteError for errors which are not a *RemoteError.
+const (
+	ErrCodeInternal = "internal"
+	ErrCodeTimeout  = "timeout"
+	ErrCodePanic    = "panic"
+)
+
+// NewMessage returns a new bus.Message identified by a new UUID.
 func NewMessage(p []byte, r string) *Message {
-	return &Message{Payload: p, ReplyTo: r}
+	return &Message{UUID: newUUID(), Payload: p, ReplyTo: r}
 }
 
-// DecodePayload deserializes data (as []byte) and creates a new struct passed by parameter.
+// dedupKey returns the key identifying m for deduplication, the IdempotencyKey
+// when set, otherwise the UUID.
+func (m *Message) dedupKey() string {
+	if m.IdempotencyKey != "" {
+		return m.IdempotencyKey
+	}
+
+	return m.UUID
+}
+
+// DecodePayload deserializes data (as []byte) and creates a new struct passed by parameter,
+// returns a *RemoteError if the message is an error reply.
 func (m *Message) DecodePayload(v interface{}) (err error) {
+	if m.Error != nil {
+		return m.Error
+	}
+
 	return json.Unmarshal(m.Payload, v)
 }
+
+// Error returns the error code followed by the error message.
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error %s: %s", e.Code, e.Message)
+}
+
+func newRemoteError(err error) *RemoteError {
+	switch e := err.(type) {
+	case *RemoteError:
+		return e
+	case *PanicError:
+		return &RemoteError{Code: ErrCodePanic, Message: fmt.Sprint(e.Value)}
+	}
+
+	if err == context.DeadlineExceeded {
+		return &RemoteError{Code: ErrCodeTimeout, Message: err.Error()}
+	}
+
+	return &RemoteError{Code: ErrCodeInternal, Message: err.Error()}
+}
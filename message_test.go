@@ -1,7 +1,9 @@
 package bus
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"testing"
 )
 
@@ -20,3 +22,38 @@ func TestMessageDecodePayload(t *testing.T) {
 		t.Fatalf("expected to decode payload message %s", err)
 	}
 }
+
+func TestMessageDecodePayloadRemoteError(t *testing.T) {
+	m := &Message{Error: &RemoteError{Code: "not_found", Message: "user not found"}}
+
+	var v struct{ Name string }
+	err := m.DecodePayload(&v)
+	rerr, ok := err.(*RemoteError)
+	if !ok {
+		t.Fatalf("expected remote error, got %v", err)
+	}
+
+	if rerr.Code != "not_found" || rerr.Message != "user not found" {
+		t.Errorf("unexpected remote error %v", rerr)
+	}
+}
+
+func TestNewRemoteError(t *testing.T) {
+	rerr := &RemoteError{Code: "not_found"}
+
+	cases := []struct {
+		err  error
+		code string
+	}{
+		{rerr, "not_found"},
+		{&PanicError{Value: "boom"}, ErrCodePanic},
+		{context.DeadlineExceeded, ErrCodeTimeout},
+		{errors.New("failed"), ErrCodeInternal},
+	}
+
+	for _, c := range cases {
+		if code := newRemoteError(c.err).Code; code != c.code {
+			t.Errorf("unexpected code %s for %v", code, c.err)
+		}
+	}
+}
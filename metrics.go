@@ -0,0 +1,206 @@
+package bus
+
+import (
+	"context"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Results reported by Metrics.
+const (
+	resultSuccess   = "success"
+	resultError     = "error"
+	resultPanic     = "panic"
+	resultTimeout   = "timeout"
+	resultInvalid   = "invalid"
+	resultDuplicate = "duplicate"
+)
+
+// Metrics collects Prometheus metrics of emitters and listeners, the same Metrics
+// can be shared by all emitters and listeners of a process. A nil *Metrics is valid
+// and collects nothing.
+type Metrics struct {
+	published          *prometheus.CounterVec
+	publishDuration    *prometheus.HistogramVec
+	asyncPending       *prometheus.GaugeVec
+	breakerState       *prometheus.GaugeVec
+	breakerTransitions *prometheus.CounterVec
+	handled            *prometheus.CounterVec
+	handlerDuration    *prometheus.HistogramVec
+	attempts           *prometheus.HistogramVec
+	requeued           *prometheus.CounterVec
+	deadLettered       *prometheus.CounterVec
+	requestDuration    *prometheus.HistogramVec
+}
+
+// NewMetrics returns a new Metrics with all metric names prefixed by namespace.
+func NewMetrics(namespace string) *Metrics {
+	return &Metrics{
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "published_total",
+			Help:      "Number of messages published by topic and result.",
+		}, []string{"topic", "result"}),
+		publishDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "publish_duration_seconds",
+			Help:      "Latency of publishing messages to nsqd.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"topic"}),
+		asyncPending: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "publish_async_pending",
+			Help:      "Number of asynchronous publishes waiting for nsqd response.",
+		}, []string{"topic"}),
+		breakerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "breaker_state",
+			Help:      "State of the circuit breaker, 0 closed, 1 half-open and 2 open.",
+		}, []string{"name"}),
+		breakerTransitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "breaker_transitions_total",
+			Help:      "Number of circuit breaker state transitions.",
+		}, []string{"name", "from", "to"}),
+		handled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "handled_total",
+			Help:      "Number of messages handled by topic, channel and result.",
+		}, []string{"topic", "channel", "result"}),
+		handlerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "handler_duration_seconds",
+			Help:      "Duration of HandlerFunc calls.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"topic", "channel"}),
+		attempts: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "handled_attempts",
+			Help:      "Delivery attempts of the handled messages.",
+			Buckets:   []float64{1, 2, 3, 5, 10, 20, 50},
+		}, []string{"topic", "channel"}),
+		requeued: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requeued_total",
+			Help:      "Number of messages requeued after a handler failure.",
+		}, []string{"topic", "channel"}),
+		deadLettered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dead_lettered_total",
+			Help:      "Number of messages which exceeded MaxAttempts by dead letter topic.",
+		}, []string{"topic", "channel", "dead_letter_topic"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Round-trip time between publishing a request and receiving its replies.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"topic"}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.published,
+		m.publishDuration,
+		m.asyncPending,
+		m.breakerState,
+		m.breakerTransitions,
+		m.handled,
+		m.handlerDuration,
+		m.attempts,
+		m.requeued,
+		m.deadLettered,
+		m.requestDuration,
+	}
+}
+
+func (m *Metrics) observePublish(topic string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+
+	m.published.WithLabelValues(topicKey(topic), resultOf(err)).Inc()
+	m.publishDuration.WithLabelValues(topicKey(topic)).Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) addAsyncPending(topic string, delta float64) {
+	if m == nil {
+		return
+	}
+
+	m.asyncPending.WithLabelValues(topicKey(topic)).Add(delta)
+}
+
+func (m *Metrics) observeBreakerState(name, from, to string, state float64) {
+	if m == nil {
+		return
+	}
+
+	m.breakerState.WithLabelValues(name).Set(state)
+	m.breakerTransitions.WithLabelValues(name, from, to).Inc()
+}
+
+func (m *Metrics) observeHandled(topic, channel string, attempts uint16, duration time.Duration, res string) {
+	if m == nil {
+		return
+	}
+
+	m.handled.WithLabelValues(topicKey(topic), channel, res).Inc()
+	m.handlerDuration.WithLabelValues(topicKey(topic), channel).Observe(duration.Seconds())
+	m.attempts.WithLabelValues(topicKey(topic), channel).Observe(float64(attempts))
+}
+
+func (m *Metrics) observeRequeued(topic, channel string, message *nsq.Message, err error) {
+	if m == nil || err == nil || message.HasResponded() || message.IsAutoResponseDisabled() {
+		return
+	}
+
+	m.requeued.WithLabelValues(topicKey(topic), channel).Inc()
+}
+
+func (m *Metrics) observeDeadLettered(topic, channel, deadLetterTopic string) {
+	if m == nil {
+		return
+	}
+
+	m.deadLettered.WithLabelValues(topicKey(topic), channel, deadLetterTopic).Inc()
+}
+
+func (m *Metrics) observeRequest(topic string, start time.Time) {
+	if m == nil {
+		return
+	}
+
+	m.requestDuration.WithLabelValues(topic).Observe(time.Since(start).Seconds())
+}
+
+func resultOf(err error) string {
+	switch err.(type) {
+	case nil:
+		return resultSuccess
+	case *PanicError:
+		return resultPanic
+	}
+
+	if err == context.DeadlineExceeded {
+		return resultTimeout
+	}
+
+	return resultError
+}
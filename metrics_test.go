@@ -0,0 +1,195 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sony/gobreaker"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		scenario string
+		function func(*testing.T)
+	}{
+		{
+			"handled messages",
+			testMetricsHandled,
+		},
+		{
+			"reply topics share a label",
+			testMetricsEphemeral,
+		},
+		{
+			"circuit breaker transitions",
+			testMetricsBreaker,
+		},
+		{
+			"nil metrics",
+			testMetricsNil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			test.function(t)
+		})
+	}
+}
+
+func testMetricsHandled(t *testing.T) {
+	metrics := NewMetrics("bus")
+	h := newHandler(context.Background(), ListenerConfig{
+		Topic:   "orders",
+		Channel: "billing",
+		Metrics: metrics,
+		HandlerFunc: func(ctx context.Context, message *Message) (reply interface{}, err error) {
+			var fail bool
+			if err = message.DecodePayload(&fail); err == nil && fail {
+				err = errors.New("failed")
+			}
+			return
+		},
+	})
+
+	h.HandleMessage(newNSQMessage(t, NewMessage([]byte(`false`), "")))
+	h.HandleMessage(newNSQMessage(t, NewMessage([]byte(`true`), "")))
+
+	values := gather(t, metrics)
+	if values[`bus_handled_total{channel="billing",result="success",topic="orders"}`] != 1 {
+		t.Errorf("expected one successful message %v", values)
+	}
+
+	if values[`bus_handled_total{channel="billing",result="error",topic="orders"}`] != 1 {
+		t.Errorf("expected one failed message %v", values)
+	}
+
+	if values[`bus_requeued_total{channel="billing",topic="orders"}`] != 1 {
+		t.Errorf("expected one requeued message %v", values)
+	}
+
+	if values[`bus_handler_duration_seconds{channel="billing",topic="orders"}`] != 2 {
+		t.Errorf("expected two handler duration observations %v", values)
+	}
+}
+
+func testMetricsEphemeral(t *testing.T) {
+	metrics := NewMetrics("bus")
+	emitter, err := NewEmitter(EmitterConfig{Address: "127.0.0.1:1", Metrics: metrics, LogLevel: LogError})
+	if err != nil {
+		t.Fatalf("expected to initialize emitter %v", err)
+	}
+	defer emitter.Stop()
+
+	for _, topic := range []string{"a.ephemeral", "b#ephemeral", "c.ephemeral"} {
+		if err := emitter.reply(context.Background(), topic, 0, true, "reply", nil); err == nil {
+			t.Fatal("expected reply to fail without nsqd")
+		}
+	}
+
+	var series, published float64
+	for name, value := range gather(t, metrics) {
+		if strings.Contains(name, "ephemeral") {
+			series++
+			if !strings.Contains(name, ephemeralTopics) {
+				t.Errorf("expected reply topics to share a label %s", name)
+			}
+		}
+		if strings.HasPrefix(name, "bus_published_total{") {
+			published += value
+		}
+	}
+
+	if series == 0 || published != 3 {
+		t.Errorf("expected reply publishes to be counted under one label, got %v series and %v publishes", series, published)
+	}
+}
+
+func testMetricsBreaker(t *testing.T) {
+	metrics := NewMetrics("bus")
+
+	var changes []string
+	settings := newBreakerSettings("orders", Breaker{
+		OnStateChange: func(name, from, to string) {
+			changes = append(changes, from+"->"+to)
+		},
+	}, metrics, newLogger(nil, LogError))
+
+	cb := gobreaker.NewCircuitBreaker(settings)
+	for i := 0; i < 2; i++ {
+		cb.Execute(func() (interface{}, error) {
+			return nil, errors.New("failed")
+		})
+	}
+
+	values := gather(t, metrics)
+	if values[`bus_breaker_state{name="nsq-emitter-circuit-breaker:orders"}`] != float64(gobreaker.StateOpen) {
+		t.Errorf("expected breaker state to be open %v", values)
+	}
+
+	if values[`bus_breaker_transitions_total{from="closed",name="nsq-emitter-circuit-breaker:orders",to="open"}`] != 1 {
+		t.Errorf("expected breaker transition %v", values)
+	}
+
+	if len(changes) != 1 || changes[0] != "closed->open" {
+		t.Errorf("expected OnStateChange to be called %v", changes)
+	}
+}
+
+func testMetricsNil(t *testing.T) {
+	settings := newBreakerSettings("orders", Breaker{}, nil, newLogger(nil, LogError))
+	cb := gobreaker.NewCircuitBreaker(settings)
+	for i := 0; i < 2; i++ {
+		cb.Execute(func() (interface{}, error) {
+			return nil, errors.New("failed")
+		})
+	}
+
+	if cb.State() != gobreaker.StateOpen {
+		t.Errorf("unexpected breaker state %v", cb.State())
+	}
+}
+
+// gather returns the value of counters and gauges, and the sample count of histograms,
+// keyed by metric name and labels.
+func gather(t *testing.T, c prometheus.Collector) map[string]float64 {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(c); err != nil {
+		t.Fatalf("expected to register collector %v", err)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("expected to gather metrics %v", err)
+	}
+
+	values := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			key := f.GetName() + "{"
+			for i, l := range m.GetLabel() {
+				if i > 0 {
+					key += ","
+				}
+				key += l.GetName() + "=\"" + l.GetValue() + "\""
+			}
+			key += "}"
+
+			switch {
+			case m.GetCounter() != nil:
+				values[key] = m.GetCounter().GetValue()
+			case m.GetGauge() != nil:
+				values[key] = m.GetGauge().GetValue()
+			case m.GetHistogram() != nil:
+				values[key] = float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,303 @@
+package bus
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type (
+	// Monitor polls nsqd /stats of every nsqd known to nsqlookupd and reports
+	// the depth and counters of each topic channel aggregated across nodes.
+	Monitor struct {
+		admin      *Admin
+		interval   time.Duration
+		thresholds []Threshold
+		onError    func(error)
+
+		mu       sync.RWMutex
+		channels map[channelKey]ChannelDepth
+		polledAt time.Time
+
+		stop chan struct{}
+		done chan struct{}
+	}
+
+	// ChannelDepth carries the depth and counters of a channel aggregated across nsqd nodes.
+	ChannelDepth struct {
+		Topic    string
+		Channel  string
+		Depth    int64
+		InFlight int64
+		Deferred int64
+		Requeued uint64
+		TimedOut uint64
+		// DepthRate is the change of Depth per second since the previous poll.
+		DepthRate float64
+	}
+
+	// NodesError is returned by Poll when the stats of some nsqd nodes could not be
+	// queried, the channels of the other nodes are still reported.
+	NodesError struct {
+		// Errors is keyed by the HTTP address of the failed nodes.
+		Errors map[string]error
+	}
+
+	channelKey struct {
+		topic   string
+		channel string
+	}
+)
+
+var (
+	channelDepthDesc = prometheus.NewDesc(
+		"nsq_channel_depth",
+		"Number of messages queued in the channel.",
+		[]string{"topic", "channel"}, nil,
+	)
+	channelInFlightDesc = prometheus.NewDesc(
+		"nsq_channel_in_flight",
+		"Number of messages in flight in the channel.",
+		[]string{"topic", "channel"}, nil,
+	)
+	channelDeferredDesc = prometheus.NewDesc(
+		"nsq_channel_deferred",
+		"Number of deferred messages in the channel.",
+		[]string{"topic", "channel"}, nil,
+	)
+	channelRequeuedDesc = prometheus.NewDesc(
+		"nsq_channel_requeued_total",
+		"Number of messages requeued in the channel.",
+		[]string{"topic", "channel"}, nil,
+	)
+	channelTimedOutDesc = prometheus.NewDesc(
+		"nsq_channel_timed_out_total",
+		"Number of messages timed out in the channel.",
+		[]string{"topic", "channel"}, nil,
+	)
+	channelDepthRateDesc = prometheus.NewDesc(
+		"nsq_channel_depth_rate",
+		"Change of the channel depth per second since the previous poll.",
+		[]string{"topic", "channel"}, nil,
+	)
+)
+
+// NewMonitor returns a new Monitor configured with the variables from the config parameter.
+func NewMonitor(mc MonitorConfig) *Monitor {
+	admin := mc.Admin
+	if admin == nil {
+		admin = NewAdmin(AdminConfig{Lookup: mc.Lookup})
+	}
+
+	interval := mc.Interval
+	if interval == 0 {
+		interval = time.Second * 30
+	}
+
+	onError := mc.OnError
+	if onError == nil {
+		logger := newLogger(mc.Logger, LogInfo)
+		onError = func(err error) {
+			logger.Error("failed to poll nsqd stats", "error", err)
+		}
+	}
+
+	return &Monitor{
+		admin:      admin,
+		interval:   interval,
+		thresholds: mc.Thresholds,
+		onError:    onError,
+		channels:   make(map[channelKey]ChannelDepth),
+	}
+}
+
+// Start polls nsqd stats every Interval until Stop is called.
+func (m *Monitor) Start() {
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+
+	go func() {
+		defer close(m.done)
+
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := m.Poll(); err != nil {
+				m.onError(err)
+			}
+
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops polling nsqd stats, it blocks until the running poll returns.
+// Stop does nothing if the monitor was not started.
+func (m *Monitor) Stop() {
+	if m.stop == nil {
+		return
+	}
+
+	close(m.stop)
+	<-m.done
+	m.stop = nil
+}
+
+// Poll queries the stats of every nsqd known to nsqlookupd once, calls the
+// exceeded thresholds callbacks and returns the channels sorted by topic and channel.
+// When some nodes fail, the channels of the others are reported along with a
+// *NodesError, and DepthRate is not computed against the partial depths.
+func (m *Monitor) Poll() ([]ChannelDepth, error) {
+	nodes, err := m.admin.Nodes()
+	if err != nil {
+		return nil, err
+	}
+
+	var nerr *NodesError
+	channels := make(map[channelKey]ChannelDepth)
+	for _, node := range nodes {
+		address := node.HTTPAddress()
+		stats, err := m.admin.WithAddress(address).Stats()
+		if err != nil {
+			if nerr == nil {
+				nerr = &NodesError{Errors: make(map[string]error)}
+			}
+			nerr.Errors[address] = err
+			continue
+		}
+
+		for _, t := range stats.Topics {
+			for _, c := range t.Channels {
+				key := channelKey{t.TopicName, c.ChannelName}
+				cd := channels[key]
+				cd.Topic = t.TopicName
+				cd.Channel = c.ChannelName
+				cd.Depth += c.Depth
+				cd.InFlight += int64(c.InFlightCount)
+				cd.Deferred += int64(c.DeferredCount)
+				cd.Requeued += c.RequeueCount
+				cd.TimedOut += c.TimeoutCount
+				channels[key] = cd
+			}
+		}
+	}
+
+	if nerr != nil && len(nerr.Errors) == len(nodes) {
+		return nil, nerr
+	}
+
+	now := time.Now()
+
+	m.mu.Lock()
+	if !m.polledAt.IsZero() && nerr == nil {
+		elapsed := now.Sub(m.polledAt).Seconds()
+		for key, cd := range channels {
+			if prev, ok := m.channels[key]; ok && elapsed > 0 {
+				cd.DepthRate = float64(cd.Depth-prev.Depth) / elapsed
+				channels[key] = cd
+			}
+		}
+	}
+	m.channels = channels
+	m.polledAt = now
+	if nerr != nil {
+		// the next poll has no complete depths to compute DepthRate against
+		m.polledAt = time.Time{}
+	}
+	m.mu.Unlock()
+
+	snapshot := m.Snapshot()
+	for _, cd := range snapshot {
+		for _, t := range m.thresholds {
+			if t.exceeded(cd) {
+				t.OnExceeded(cd)
+			}
+		}
+	}
+
+	if nerr != nil {
+		return snapshot, nerr
+	}
+
+	return snapshot, nil
+}
+
+func (e *NodesError) Error() string {
+	addresses := make([]string, 0, len(e.Errors))
+	for address := range e.Errors {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	failures := make([]string, len(addresses))
+	for i, address := range addresses {
+		failures[i] = fmt.Sprintf("%s: %v", address, e.Errors[address])
+	}
+
+	return fmt.Sprintf("failed to poll %d nsqd nodes: %s", len(addresses), strings.Join(failures, "; "))
+}
+
+// Snapshot returns the channels of the last poll sorted by topic and channel.
+func (m *Monitor) Snapshot() []ChannelDepth {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	snapshot := make([]ChannelDepth, 0, len(m.channels))
+	for _, cd := range m.channels {
+		snapshot = append(snapshot, cd)
+	}
+
+	sort.Slice(snapshot, func(i, j int) bool {
+		if snapshot[i].Topic != snapshot[j].Topic {
+			return snapshot[i].Topic < snapshot[j].Topic
+		}
+		return snapshot[i].Channel < snapshot[j].Channel
+	})
+
+	return snapshot
+}
+
+// Describe implements prometheus.Collector.
+func (m *Monitor) Describe(ch chan<- *prometheus.Desc) {
+	ch <- channelDepthDesc
+	ch <- channelInFlightDesc
+	ch <- channelDeferredDesc
+	ch <- channelRequeuedDesc
+	ch <- channelTimedOutDesc
+	ch <- channelDepthRateDesc
+}
+
+// Collect implements prometheus.Collector, reporting the channels of the last poll.
+func (m *Monitor) Collect(ch chan<- prometheus.Metric) {
+	for _, cd := range m.Snapshot() {
+		ch <- prometheus.MustNewConstMetric(channelDepthDesc, prometheus.GaugeValue, float64(cd.Depth), cd.Topic, cd.Channel)
+		ch <- prometheus.MustNewConstMetric(channelInFlightDesc, prometheus.GaugeValue, float64(cd.InFlight), cd.Topic, cd.Channel)
+		ch <- prometheus.MustNewConstMetric(channelDeferredDesc, prometheus.GaugeValue, float64(cd.Deferred), cd.Topic, cd.Channel)
+		ch <- prometheus.MustNewConstMetric(channelRequeuedDesc, prometheus.CounterValue, float64(cd.Requeued), cd.Topic, cd.Channel)
+		ch <- prometheus.MustNewConstMetric(channelTimedOutDesc, prometheus.CounterValue, float64(cd.TimedOut), cd.Topic, cd.Channel)
+		ch <- prometheus.MustNewConstMetric(channelDepthRateDesc, prometheus.GaugeValue, cd.DepthRate, cd.Topic, cd.Channel)
+	}
+}
+
+func (t Threshold) exceeded(cd ChannelDepth) bool {
+	if t.OnExceeded == nil {
+		return false
+	}
+
+	if (t.Topic != "" && t.Topic != cd.Topic) || (t.Channel != "" && t.Channel != cd.Channel) {
+		return false
+	}
+
+	return (t.MaxDepth > 0 && cd.Depth > t.MaxDepth) ||
+		(t.MaxInFlight > 0 && cd.InFlight > t.MaxInFlight) ||
+		(t.MaxDepthRate > 0 && cd.DepthRate > t.MaxDepthRate)
+}
@@ -0,0 +1,207 @@
+package bus
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMonitor(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		scenario string
+		function func(*testing.T)
+	}{
+		{
+			"poll aggregates nodes",
+			testMonitorPoll,
+		},
+		{
+			"poll keeps the nodes answering",
+			testMonitorPollNodeFailure,
+		},
+		{
+			"thresholds",
+			testMonitorThresholds,
+		},
+		{
+			"prometheus collector",
+			testMonitorCollector,
+		},
+		{
+			"start and stop",
+			testMonitorStartStop,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			test.function(t)
+		})
+	}
+}
+
+func testMonitorPoll(t *testing.T) {
+	var depth int64 = 10
+	nsqd1 := newNSQDStatsMock(&depth)
+	defer nsqd1.Close()
+	nsqd2 := newNSQDStatsMock(&depth)
+	defer nsqd2.Close()
+	lookupd := newLookupdMock(t, serverAddress(nsqd1), serverAddress(nsqd2))
+	defer lookupd.Close()
+
+	monitor := NewMonitor(MonitorConfig{Lookup: []string{serverAddress(lookupd)}})
+	channels, err := monitor.Poll()
+	if err != nil {
+		t.Fatalf("expected to poll stats %v", err)
+	}
+
+	if len(channels) != 1 {
+		t.Fatalf("unexpected channels %+v", channels)
+	}
+
+	cd := channels[0]
+	if cd.Topic != "orders" || cd.Channel != "billing" || cd.Depth != 20 || cd.InFlight != 4 ||
+		cd.Deferred != 4 || cd.Requeued != 6 || cd.TimedOut != 8 || cd.DepthRate != 0 {
+		t.Errorf("unexpected channel %+v", cd)
+	}
+
+	atomic.StoreInt64(&depth, 20)
+	time.Sleep(time.Millisecond * 10)
+	channels, err = monitor.Poll()
+	if err != nil {
+		t.Fatalf("expected to poll stats %v", err)
+	}
+
+	if channels[0].Depth != 40 || channels[0].DepthRate <= 0 {
+		t.Errorf("expected depth to grow %+v", channels[0])
+	}
+}
+
+func testMonitorPollNodeFailure(t *testing.T) {
+	var depth int64 = 10
+	nsqd := newNSQDStatsMock(&depth)
+	defer nsqd.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	lookupd := newLookupdMock(t, serverAddress(nsqd), serverAddress(failing))
+	defer lookupd.Close()
+
+	monitor := NewMonitor(MonitorConfig{Lookup: []string{serverAddress(lookupd)}})
+	channels, err := monitor.Poll()
+
+	nerr, ok := err.(*NodesError)
+	if !ok || len(nerr.Errors) != 1 || nerr.Errors[serverAddress(failing)] == nil {
+		t.Fatalf("expected the failing node error %v", err)
+	}
+
+	if len(channels) != 1 || channels[0].Depth != 10 {
+		t.Errorf("expected the channels of the answering node %+v", channels)
+	}
+
+	failing.Close()
+	nsqd.Close()
+	if channels, err := monitor.Poll(); err == nil || channels != nil {
+		t.Errorf("expected poll to fail when every node fails %v %v", channels, err)
+	}
+
+	if snapshot := monitor.Snapshot(); len(snapshot) != 1 {
+		t.Errorf("expected failed poll to keep the last snapshot %+v", snapshot)
+	}
+}
+
+func testMonitorThresholds(t *testing.T) {
+	var depth int64 = 10
+	nsqd := newNSQDStatsMock(&depth)
+	defer nsqd.Close()
+	lookupd := newLookupdMock(t, serverAddress(nsqd))
+	defer lookupd.Close()
+
+	var exceeded []string
+	record := func(name string) func(ChannelDepth) {
+		return func(cd ChannelDepth) { exceeded = append(exceeded, name) }
+	}
+
+	monitor := NewMonitor(MonitorConfig{
+		Lookup: []string{serverAddress(lookupd)},
+		Thresholds: []Threshold{
+			{MaxDepth: 5, OnExceeded: record("any depth")},
+			{Topic: "orders", Channel: "billing", MaxInFlight: 1, OnExceeded: record("billing in flight")},
+			{Topic: "users", MaxDepth: 5, OnExceeded: record("users depth")},
+			{MaxDepth: 50, OnExceeded: record("high depth")},
+		},
+	})
+
+	if _, err := monitor.Poll(); err != nil {
+		t.Fatalf("expected to poll stats %v", err)
+	}
+
+	if fmt.Sprint(exceeded) != "[any depth billing in flight]" {
+		t.Errorf("unexpected exceeded thresholds %v", exceeded)
+	}
+}
+
+func testMonitorCollector(t *testing.T) {
+	var depth int64 = 10
+	nsqd := newNSQDStatsMock(&depth)
+	defer nsqd.Close()
+	lookupd := newLookupdMock(t, serverAddress(nsqd))
+	defer lookupd.Close()
+
+	monitor := NewMonitor(MonitorConfig{Lookup: []string{serverAddress(lookupd)}})
+	if _, err := monitor.Poll(); err != nil {
+		t.Fatalf("expected to poll stats %v", err)
+	}
+
+	values := gather(t, monitor)
+	labels := `{channel="billing",topic="orders"}`
+	if values["nsq_channel_depth"+labels] != 10 || values["nsq_channel_in_flight"+labels] != 2 || values["nsq_channel_timed_out_total"+labels] != 4 {
+		t.Errorf("unexpected metrics %v", values)
+	}
+}
+
+func testMonitorStartStop(t *testing.T) {
+	var depth int64 = 10
+	nsqd := newNSQDStatsMock(&depth)
+	defer nsqd.Close()
+	lookupd := newLookupdMock(t, serverAddress(nsqd))
+	defer lookupd.Close()
+
+	polled := make(chan ChannelDepth, 1)
+	monitor := NewMonitor(MonitorConfig{
+		Lookup:   []string{serverAddress(lookupd)},
+		Interval: time.Millisecond * 10,
+		Thresholds: []Threshold{
+			{MaxDepth: 1, OnExceeded: func(cd ChannelDepth) {
+				select {
+				case polled <- cd:
+				default:
+				}
+			}},
+		},
+	})
+
+	// stopping a monitor not started is a no-op
+	monitor.Stop()
+
+	monitor.Start()
+	select {
+	case <-polled:
+	case <-time.After(time.Second):
+		t.Error("expected monitor to poll stats")
+	}
+	monitor.Stop()
+}
+
+// newNSQDStatsMock returns a nsqd stand-in reporting a single channel with the given depth.
+func newNSQDStatsMock(depth *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"topics":[{"topic_name":"orders","channels":[{"channel_name":"billing","depth":%d,"in_flight_count":2,"deferred_count":2,"requeue_count":3,"timeout_count":4}]}]}`, atomic.LoadInt64(depth))
+	}))
+}
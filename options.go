@@ -0,0 +1,63 @@
+package bus
+
+import "context"
+
+// EmitOption customizes a single Emit, EmitAsync or Request call.
+type EmitOption func(*emitOptions)
+
+type emitOptions struct {
+	ctx            context.Context
+	idempotencyKey string
+	partitionKey   string
+	messageType    string
+}
+
+// WithIdempotencyKey sets the idempotency key of the message, listeners with a
+// Deduplicator collapse the messages sharing the same key, e.g. a publish retried
+// after a timeout, and the emitter drops emits of a key it recently published.
+func WithIdempotencyKey(key string) EmitOption {
+	return func(o *emitOptions) {
+		o.idempotencyKey = key
+	}
+}
+
+// WithPartitionKey sets the partition key of the message, messages sharing the same key
+// are numbered in emit order so Ordered listeners handle them in sequence, and are
+// published to the same sub-topic when EmitterConfig.Partitions is set.
+func WithPartitionKey(key string) EmitOption {
+	return func(o *emitOptions) {
+		o.partitionKey = key
+	}
+}
+
+// WithType sets the Type of the message, overriding the name of the payload Go type.
+func WithType(name string) EmitOption {
+	return func(o *emitOptions) {
+		o.messageType = name
+	}
+}
+
+// WithContext sets the context of the emit or request, retries stop once ctx is done or its
+// deadline is too close for the next backoff, and ctx carries the parent span.
+func WithContext(ctx context.Context) EmitOption {
+	return func(o *emitOptions) {
+		o.ctx = ctx
+	}
+}
+
+func newEmitOptions(opts []EmitOption) emitOptions {
+	o := emitOptions{ctx: context.Background()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// apply sets the envelope fields of the options on m.
+func (o emitOptions) apply(m *Message) {
+	m.IdempotencyKey = o.idempotencyKey
+	if o.messageType != "" {
+		m.Type = o.messageType
+	}
+}
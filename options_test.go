@@ -0,0 +1,227 @@
+package bus
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		scenario string
+		function func(*testing.T)
+	}{
+		{
+			"emitter drops duplicate emits",
+			testEmitterIdempotencyCache,
+		},
+		{
+			"emitter retries failed async emits",
+			testEmitterIdempotencyAsyncFailure,
+		},
+		{
+			"listener collapses messages by key",
+			testHandlerIdempotencyKey,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			test.function(t)
+		})
+	}
+}
+
+func testEmitterIdempotencyCache(t *testing.T) {
+	dir := t.TempDir()
+	emitter, err := NewEmitter(EmitterConfig{
+		Address:  "127.0.0.1:1",
+		LogLevel: LogError,
+		Spool:    SpoolConfig{Dir: dir},
+	})
+	if err != nil {
+		t.Fatalf("expected to initialize emitter %v", err)
+	}
+
+	emits := []func() error{
+		func() error { return emitter.Emit("orders", "created", WithIdempotencyKey("order-1")) },
+		func() error { return emitter.Emit("orders", "created", WithIdempotencyKey("order-1")) },
+		func() error { return emitter.EmitAsync("orders", "created", WithIdempotencyKey("order-1")) },
+		func() error { return emitter.EmitAsync("orders", "updated", WithIdempotencyKey("order-2")) },
+		func() error { return emitter.Emit("orders", "updated") },
+	}
+
+	for _, emit := range emits {
+		if err := emit(); err != nil {
+			t.Fatalf("expected emit to succeed %v", err)
+		}
+	}
+	emitter.Stop()
+
+	s, err := openSpool(SpoolConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("expected to reopen spool %v", err)
+	}
+	defer s.close()
+
+	var keys []string
+	for {
+		_, body, ok, err := s.peek()
+		if err != nil || !ok {
+			break
+		}
+		m := Message{}
+		json.Unmarshal(body, &m)
+		keys = append(keys, m.IdempotencyKey)
+		s.commit()
+	}
+
+	if len(keys) != 3 || keys[0] != "order-1" || keys[1] != "order-2" || keys[2] != "" {
+		t.Errorf("unexpected emitted keys %q", keys)
+	}
+}
+
+func testEmitterIdempotencyAsyncFailure(t *testing.T) {
+	nsqd := newNSQDMock(t, "E_PUB_FAILED failed", "OK")
+	defer nsqd.Close()
+	emitter, err := NewEmitter(EmitterConfig{Address: nsqd.address, LogLevel: LogError})
+	if err != nil {
+		t.Fatalf("expected to initialize emitter %v", err)
+	}
+	defer emitter.Stop()
+
+	for i := 0; i < 3; i++ {
+		if err := emitter.EmitAsync("orders", "created", WithIdempotencyKey("order-1")); err != nil {
+			t.Fatalf("expected emit to succeed %v", err)
+		}
+		emitter.async.Wait()
+	}
+
+	if published := nsqd.published(); published != 2 {
+		t.Errorf("expected a failed async emit to be retried once, got %d publishes", published)
+	}
+}
+
+func testHandlerIdempotencyKey(t *testing.T) {
+	calls := 0
+	h := newHandler(context.Background(), ListenerConfig{
+		Topic:        "orders",
+		Channel:      "billing",
+		Deduplicator: NewMemoryDeduplicator(10, time.Minute),
+		HandlerFunc: func(ctx context.Context, message *Message) (interface{}, error) {
+			calls++
+			return nil, nil
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		m := NewMessage([]byte(`"created"`), "")
+		m.IdempotencyKey = "order-1"
+		h.HandleMessage(newNSQMessage(t, m))
+	}
+
+	if calls != 1 {
+		t.Errorf("expected messages sharing a key to be handled once %d", calls)
+	}
+}
+
+// nsqdMock speaks enough of the nsqd TCP protocol for a producer, each PUB is
+// answered with the next reply, replies starting with E_ are sent as errors.
+type nsqdMock struct {
+	net.Listener
+	address string
+	mu      sync.Mutex
+	replies []string
+	pubs    int
+}
+
+func newNSQDMock(t *testing.T, replies ...string) *nsqdMock {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected to listen %v", err)
+	}
+
+	m := &nsqdMock{Listener: l, address: l.Addr().String(), replies: replies}
+	go func() {
+		for {
+			conn, err := m.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+
+	return m
+}
+
+func (m *nsqdMock) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		var size int32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, int64(size)); err != nil {
+			return
+		}
+
+		reply := "OK"
+		if strings.HasPrefix(line, "PUB ") {
+			reply = m.next()
+		}
+
+		frameType := int32(0)
+		if strings.HasPrefix(reply, "E_") {
+			frameType = 1
+		}
+		frame := make([]byte, 8, 8+len(reply))
+		binary.BigEndian.PutUint32(frame, uint32(4+len(reply)))
+		binary.BigEndian.PutUint32(frame[4:], uint32(frameType))
+		if _, err := conn.Write(append(frame, reply...)); err != nil {
+			return
+		}
+	}
+}
+
+func (m *nsqdMock) next() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pubs++
+	if len(m.replies) == 0 {
+		return "OK"
+	}
+	reply := m.replies[0]
+	m.replies = m.replies[1:]
+	return reply
+}
+
+func (m *nsqdMock) published() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.pubs
+}
@@ -0,0 +1,293 @@
+package bus
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+// maxOrderedKeys bounds the number of partition keys whose expected sequence is
+// remembered, idle keys are forgotten beyond it.
+const maxOrderedKeys = 10000
+
+type (
+	// orderedQueue handles the messages of each partition key serially, in the order
+	// of their PartitionSeq, buffering the messages arriving ahead of a missing one.
+	orderedQueue struct {
+		h           *handler
+		maxBuffered int
+		maxGapWait  time.Duration
+
+		mu         sync.Mutex
+		partitions map[string]*partition
+	}
+
+	partition struct {
+		next    uint64
+		pending map[uint64]*nsq.Message
+		running bool
+		skipGap bool
+		timer   *time.Timer
+	}
+
+	seqEntry struct {
+		key string
+		seq uint64
+	}
+
+	partitionHeader struct {
+		PartitionKey string
+		PartitionSeq uint64
+	}
+)
+
+// PartitionTopic returns the sub-topic of topic the messages with the partition key
+// are published to, e.g. "orders.p3", when the emitter has partitions sub-topics.
+func PartitionTopic(topic, key string, partitions int) string {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return fmt.Sprintf("%s.p%d", topic, h.Sum32()%uint32(partitions))
+}
+
+// nextSeq returns the next sequence number of the partition key. The sequences of up to
+// maxOrderedKeys keys are kept, the least recently used key is forgotten beyond it and
+// starts again at 1, listeners handle sequences below the expected one without waiting.
+func (e *Emitter) nextSeq(key string) uint64 {
+	e.seqMu.Lock()
+	defer e.seqMu.Unlock()
+
+	if el, ok := e.seqs[key]; ok {
+		entry := el.Value.(*seqEntry)
+		entry.seq++
+		e.seqOrder.MoveToFront(el)
+		return entry.seq
+	}
+
+	if e.seqOrder.Len() >= maxOrderedKeys {
+		oldest := e.seqOrder.Back()
+		e.seqOrder.Remove(oldest)
+		delete(e.seqs, oldest.Value.(*seqEntry).key)
+	}
+
+	e.seqs[key] = e.seqOrder.PushFront(&seqEntry{key: key, seq: 1})
+	return 1
+}
+
+// releaseSeq gives back the sequence of a message which failed to publish, so the next
+// emit of the key reuses it. A sequence already followed by another one is kept and the
+// gap it leaves is skipped by the listeners after MaxGapWait.
+func (e *Emitter) releaseSeq(m *Message) {
+	if m.PartitionKey == "" {
+		return
+	}
+
+	e.seqMu.Lock()
+	defer e.seqMu.Unlock()
+
+	if el, ok := e.seqs[m.PartitionKey]; ok {
+		if entry := el.Value.(*seqEntry); entry.seq == m.PartitionSeq {
+			entry.seq--
+		}
+	}
+}
+
+func newOrderedQueue(h *handler) *orderedQueue {
+	maxBuffered := h.lc.MaxBufferedPerKey
+	if maxBuffered == 0 {
+		maxBuffered = 100
+	}
+
+	maxGapWait := h.lc.MaxGapWait
+	if maxGapWait == 0 {
+		maxGapWait = h.lc.MsgTimeout / 2
+	}
+	if maxGapWait <= 0 {
+		maxGapWait = defaultMsgTimeout / 2
+	}
+
+	q := &orderedQueue{
+		h:           h,
+		maxBuffered: maxBuffered,
+		maxGapWait:  maxGapWait,
+		partitions:  make(map[string]*partition),
+	}
+
+	go func() {
+		<-h.ctx.Done()
+		q.flush()
+	}()
+
+	return q
+}
+
+// partitionOf returns the partition key and sequence of an encoded message.
+func partitionOf(body []byte) (string, uint64) {
+	var header partitionHeader
+	if err := json.Unmarshal(body, &header); err != nil {
+		return "", 0
+	}
+
+	return header.PartitionKey, header.PartitionSeq
+}
+
+// enqueue adds the message of the partition key at position seq, the message is
+// responded once handled.
+func (q *orderedQueue) enqueue(key string, seq uint64, message *nsq.Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.h.ctx.Err() != nil {
+		q.h.requeue(message, 0)
+		return
+	}
+
+	p := q.partition(key)
+	if p.next == 0 {
+		p.next = seq
+	}
+
+	if buffered, ok := p.pending[seq]; ok {
+		if buffered.ID != message.ID {
+			// a duplicate publish, e.g. a retried one, of the buffered message
+			q.h.finish(message)
+			return
+		}
+
+		// nsqd redelivered the buffered message after MsgTimeout, the new delivery
+		// replaces it and the timed out one must not be responded
+		q.h.responded()
+	}
+
+	p.pending[seq] = message
+	if !p.running {
+		p.running = true
+		go q.run(p)
+	}
+}
+
+func (q *orderedQueue) partition(key string) *partition {
+	if p, ok := q.partitions[key]; ok {
+		return p
+	}
+
+	if len(q.partitions) >= maxOrderedKeys {
+		for k, p := range q.partitions {
+			if !p.running && len(p.pending) == 0 {
+				delete(q.partitions, k)
+			}
+		}
+	}
+
+	p := &partition{pending: make(map[uint64]*nsq.Message)}
+	q.partitions[key] = p
+	return p
+}
+
+// run handles the pending messages of p in order until the next one is missing.
+func (q *orderedQueue) run(p *partition) {
+	for {
+		q.mu.Lock()
+		seq, message := q.pick(p)
+		if message == nil {
+			p.running = false
+			q.armGapTimer(p)
+			q.mu.Unlock()
+			return
+		}
+		q.mu.Unlock()
+
+		err := q.process(message)
+
+		q.mu.Lock()
+		if err == nil && seq >= p.next {
+			p.next = seq + 1
+		}
+		q.mu.Unlock()
+	}
+}
+
+// pick removes and returns the lowest pending message if it is the expected one,
+// or if the missing messages were waited for MaxGapWait or MaxBufferedPerKey is exceeded.
+func (q *orderedQueue) pick(p *partition) (uint64, *nsq.Message) {
+	if len(p.pending) == 0 {
+		return 0, nil
+	}
+
+	var lowest uint64
+	first := true
+	for seq := range p.pending {
+		if first || seq < lowest {
+			lowest, first = seq, false
+		}
+	}
+
+	if lowest > p.next && !p.skipGap && len(p.pending) <= q.maxBuffered {
+		return 0, nil
+	}
+
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+
+	p.skipGap = false
+	message := p.pending[lowest]
+	delete(p.pending, lowest)
+	return lowest, message
+}
+
+func (q *orderedQueue) armGapTimer(p *partition) {
+	if len(p.pending) == 0 || p.timer != nil {
+		return
+	}
+
+	p.timer = time.AfterFunc(q.maxGapWait, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		p.timer = nil
+		p.skipGap = true
+		if !p.running {
+			p.running = true
+			go q.run(p)
+		}
+	})
+}
+
+func (q *orderedQueue) process(message *nsq.Message) error {
+	if err := q.h.ctx.Err(); err != nil {
+		q.h.requeue(message, 0)
+		return err
+	}
+
+	err := q.h.handle(message)
+	if err != nil {
+		q.h.requeue(message, -1)
+		return err
+	}
+
+	q.h.finish(message)
+	return nil
+}
+
+// flush requeues the pending messages once the listener is stopped.
+func (q *orderedQueue) flush() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, p := range q.partitions {
+		if p.timer != nil {
+			p.timer.Stop()
+			p.timer = nil
+		}
+
+		for seq, message := range p.pending {
+			q.h.requeue(message, 0)
+			delete(p.pending, seq)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOrdered(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		scenario string
+		function func(*testing.T)
+	}{
+		{
+			"partition topic",
+			testPartitionTopic,
+		},
+		{
+			"emitter numbers messages per key",
+			testEmitterPartition,
+		},
+		{
+			"emitter forgets least recently used keys",
+			testEmitterPartitionEviction,
+		},
+		{
+			"emitter reuses sequence of failed publishes",
+			testEmitterPartitionFailure,
+		},
+		{
+			"handles out of order arrivals in sequence",
+			testOrderedReorder,
+		},
+		{
+			"skips gap beyond max buffered",
+			testOrderedMaxBuffered,
+		},
+		{
+			"skips gap after max gap wait",
+			testOrderedMaxGapWait,
+		},
+		{
+			"duplicate sequence",
+			testOrderedDuplicate,
+		},
+		{
+			"requeues pending messages on stop",
+			testOrderedStop,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			test.function(t)
+		})
+	}
+}
+
+func testPartitionTopic(t *testing.T) {
+	topic := PartitionTopic("orders", "order-123", 8)
+	if topic != PartitionTopic("orders", "order-123", 8) || !strings.HasPrefix(topic, "orders.p") {
+		t.Errorf("unexpected partition topic %s", topic)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		seen[PartitionTopic("orders", fmt.Sprint("order-", i), 4)] = true
+	}
+
+	if len(seen) != 4 || !seen["orders.p0"] || !seen["orders.p3"] {
+		t.Errorf("unexpected partition topics %v", seen)
+	}
+}
+
+func testEmitterPartition(t *testing.T) {
+	emitter, err := NewEmitter(EmitterConfig{Partitions: 4})
+	if err != nil {
+		t.Fatalf("expected to initialize emitter %v", err)
+	}
+	defer emitter.Stop()
+
+	var got []string
+	for _, key := range []string{"a", "b", "a", ""} {
+		m := NewMessage(nil, "")
+		topic := emitter.partition("orders", key, m)
+		got = append(got, fmt.Sprintf("%s:%s:%d", topic, m.PartitionKey, m.PartitionSeq))
+	}
+
+	expected := fmt.Sprintf("[%s:a:1 %s:b:1 %s:a:2 orders::0]",
+		PartitionTopic("orders", "a", 4), PartitionTopic("orders", "b", 4), PartitionTopic("orders", "a", 4))
+	if fmt.Sprint(got) != expected {
+		t.Errorf("unexpected partitions %v", got)
+	}
+}
+
+func testEmitterPartitionEviction(t *testing.T) {
+	emitter, err := NewEmitter(EmitterConfig{Partitions: 4})
+	if err != nil {
+		t.Fatalf("expected to initialize emitter %v", err)
+	}
+	defer emitter.Stop()
+
+	emitter.nextSeq("first")
+	emitter.nextSeq("recent")
+	for i := 0; i < maxOrderedKeys-2; i++ {
+		emitter.nextSeq(fmt.Sprint("order-", i))
+	}
+	emitter.nextSeq("recent")
+	emitter.nextSeq("new")
+
+	if n := len(emitter.seqs); n != maxOrderedKeys {
+		t.Errorf("expected %d kept keys, got %d", maxOrderedKeys, n)
+	}
+
+	if seq := emitter.nextSeq("recent"); seq != 3 {
+		t.Errorf("expected recently used key to be kept, got seq %d", seq)
+	}
+
+	if seq := emitter.nextSeq("first"); seq != 1 {
+		t.Errorf("expected least recently used key to start again, got seq %d", seq)
+	}
+}
+
+func testEmitterPartitionFailure(t *testing.T) {
+	emitter, err := NewEmitter(EmitterConfig{Address: "127.0.0.1:1", LogLevel: LogError})
+	if err != nil {
+		t.Fatalf("expected to initialize emitter %v", err)
+	}
+	defer emitter.Stop()
+
+	emitter.nextSeq("order-1")
+	for i := 0; i < 2; i++ {
+		if err := emitter.Emit("orders", "created", WithPartitionKey("order-1")); err == nil {
+			t.Fatal("expected emit to fail without nsqd")
+		}
+		if err := emitter.EmitAsync("orders", "created", WithPartitionKey("order-1")); err == nil {
+			t.Fatal("expected async emit to fail without nsqd")
+		}
+	}
+
+	if seq := emitter.nextSeq("order-1"); seq != 2 {
+		t.Errorf("expected failed publishes to give back their sequence, got seq %d", seq)
+	}
+
+	nsqd := newNSQDMock(t, "E_PUB_FAILED failed")
+	defer nsqd.Close()
+	async, err := NewEmitter(EmitterConfig{Address: nsqd.address, LogLevel: LogError})
+	if err != nil {
+		t.Fatalf("expected to initialize emitter %v", err)
+	}
+	defer async.Stop()
+
+	if err := async.EmitAsync("orders", "created", WithPartitionKey("order-1")); err != nil {
+		t.Fatalf("expected async emit to succeed %v", err)
+	}
+	async.async.Wait()
+	if seq := async.nextSeq("order-1"); seq != 1 {
+		t.Errorf("expected a rejected async publish to give back its sequence, got seq %d", seq)
+	}
+
+	m := NewMessage(nil, "")
+	emitter.partition("orders", "order-2", m)
+	emitter.partition("orders", "order-2", NewMessage(nil, ""))
+	emitter.releaseSeq(m)
+	if seq := emitter.nextSeq("order-2"); seq != 3 {
+		t.Errorf("expected a followed sequence to be kept, got seq %d", seq)
+	}
+}
+
+func testOrderedReorder(t *testing.T) {
+	h, handled := newOrderedHandler(t, ListenerConfig{})
+	delegate := deliverOrdered(t, h, "a:1", "a:3", "b:7", "a:2", "a:4")
+
+	waitHandled(t, handled, 5)
+	if got := handled.byKey("a"); fmt.Sprint(got) != "[1 2 3 4]" {
+		t.Errorf("unexpected handling order %v", got)
+	}
+
+	delegate.mu.Lock()
+	defer delegate.mu.Unlock()
+	if delegate.finished != 5 {
+		t.Errorf("expected messages to be finished %d", delegate.finished)
+	}
+}
+
+func testOrderedMaxBuffered(t *testing.T) {
+	h, handled := newOrderedHandler(t, ListenerConfig{MaxBufferedPerKey: 1, MaxGapWait: time.Minute})
+	deliverOrdered(t, h, "a:1", "a:3", "a:4")
+
+	waitHandled(t, handled, 3)
+	if got := handled.byKey("a"); fmt.Sprint(got) != "[1 3 4]" {
+		t.Errorf("unexpected handling order %v", got)
+	}
+}
+
+func testOrderedMaxGapWait(t *testing.T) {
+	h, handled := newOrderedHandler(t, ListenerConfig{MaxGapWait: time.Millisecond * 20})
+	deliverOrdered(t, h, "a:1", "a:3")
+
+	time.Sleep(time.Millisecond * 5)
+	if got := handled.byKey("a"); fmt.Sprint(got) != "[1]" {
+		t.Errorf("expected message to wait for the gap %v", got)
+	}
+
+	waitHandled(t, handled, 2)
+	if got := handled.byKey("a"); fmt.Sprint(got) != "[1 3]" {
+		t.Errorf("unexpected handling order %v", got)
+	}
+}
+
+func testOrderedDuplicate(t *testing.T) {
+	h, handled := newOrderedHandler(t, ListenerConfig{MaxGapWait: time.Minute})
+	delegate := &messageDelegateMock{}
+	deliver := func(seq uint64, id string) {
+		m := NewMessage([]byte(fmt.Sprintf(`"a:%d"`, seq)), "")
+		m.PartitionKey, m.PartitionSeq = "a", seq
+
+		message := newNSQMessage(t, m)
+		copy(message.ID[:], id)
+		message.Delegate = delegate
+		if err := h.HandleMessage(message); err != nil {
+			t.Fatalf("expected message to be enqueued %v", err)
+		}
+	}
+
+	deliver(1, "id-1")
+	waitHandled(t, handled, 1)
+
+	deliver(3, "id-3")
+	deliver(3, "id-3-retried")
+	deliver(3, "id-3")
+	deliver(2, "id-2")
+
+	waitHandled(t, handled, 3)
+	if got := handled.byKey("a"); fmt.Sprint(got) != "[1 2 3]" {
+		t.Errorf("expected duplicates to be handled once %v", got)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.waitIdle()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected no message to be left in flight")
+	}
+
+	delegate.mu.Lock()
+	defer delegate.mu.Unlock()
+	if delegate.finished != 4 {
+		t.Errorf("expected handled messages and the duplicate publish to be finished, got %d", delegate.finished)
+	}
+}
+
+func testOrderedStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	handled := &orderedRecorder{}
+	h := newHandler(ctx, ListenerConfig{
+		Topic:       "orders",
+		Channel:     "billing",
+		Ordered:     true,
+		MaxGapWait:  time.Minute,
+		HandlerFunc: handled.handle,
+	})
+
+	delegate := deliverOrdered(t, h, "a:1", "a:3")
+	waitHandled(t, handled, 1)
+	cancel()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		delegate.mu.Lock()
+		requeued := delegate.requeued
+		delegate.mu.Unlock()
+		if requeued == 1 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Error("expected pending message to be requeued")
+}
+
+func newOrderedHandler(t *testing.T, lc ListenerConfig) (*handler, *orderedRecorder) {
+	handled := &orderedRecorder{}
+	lc.Topic = "orders"
+	lc.Channel = "billing"
+	lc.Ordered = true
+	lc.HandlerFunc = handled.handle
+	return newHandler(context.Background(), lc), handled
+}
+
+// deliverOrdered delivers messages given as "key:seq" sharing a single delegate.
+func deliverOrdered(t *testing.T, h *handler, messages ...string) *messageDelegateMock {
+	delegate := &messageDelegateMock{}
+	for _, message := range messages {
+		m := NewMessage([]byte(fmt.Sprintf("%q", message)), "")
+		fmt.Sscanf(strings.Replace(message, ":", " ", 1), "%s %d", &m.PartitionKey, &m.PartitionSeq)
+
+		nsqMessage := newNSQMessage(t, m)
+		nsqMessage.Delegate = delegate
+		if err := h.HandleMessage(nsqMessage); err != nil {
+			t.Fatalf("expected message to be enqueued %v", err)
+		}
+	}
+
+	return delegate
+}
+
+type orderedRecorder struct {
+	mu      sync.Mutex
+	handled []string
+}
+
+func (r *orderedRecorder) handle(ctx context.Context, m *Message) (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handled = append(r.handled, fmt.Sprintf("%s:%d", m.PartitionKey, m.PartitionSeq))
+	return nil, nil
+}
+
+func (r *orderedRecorder) byKey(key string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var seqs []string
+	for _, h := range r.handled {
+		if strings.HasPrefix(h, key+":") {
+			seqs = append(seqs, strings.TrimPrefix(h, key+":"))
+		}
+	}
+	return seqs
+}
+
+func waitHandled(t *testing.T, r *orderedRecorder, n int) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		r.mu.Lock()
+		count := len(r.handled)
+		r.mu.Unlock()
+		if count >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d handled messages", n)
+}
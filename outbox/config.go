@@ -0,0 +1,27 @@
+package outbox
+
+import (
+	"time"
+
+	bus "github.com/rafaeljesus/nsq-event-bus"
+)
+
+// Config carries the configuration of the outbox table.
+type Config struct {
+	// Dialect is the SQL dialect of the database, default value is SQLite.
+	Dialect Dialect
+	// Table is the name of the outbox table, default value is "bus_outbox".
+	Table string
+}
+
+// RelayConfig carries the variables to tune the relay polling the outbox table.
+type RelayConfig struct {
+	// Interval is the period between polls of the outbox table. Default value is 1 second.
+	Interval time.Duration
+	// BatchSize is the maximum number of messages read and published per poll. Default value is 100.
+	BatchSize int
+	// OnError is called when a poll fails, errors are logged if OnError is nil.
+	OnError func(error)
+	// Logger logs the failed polls when OnError is nil, default value logs to the standard logger.
+	Logger bus.Logger
+}
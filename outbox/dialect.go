@@ -0,0 +1,65 @@
+package outbox
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dialect is the SQL dialect of the database holding the outbox table.
+type Dialect int
+
+// Supported dialects.
+const (
+	SQLite Dialect = iota
+	Postgres
+)
+
+// placeholder returns the bind parameter of the nth argument, starting at 1.
+func (d Dialect) placeholder(n int) string {
+	if d == Postgres {
+		return fmt.Sprintf("$%d", n)
+	}
+
+	return "?"
+}
+
+// placeholders returns count bind parameters separated by commas, starting at from.
+func (d Dialect) placeholders(from, count int) string {
+	params := make([]string, count)
+	for i := range params {
+		params[i] = d.placeholder(from + i)
+	}
+
+	return strings.Join(params, ", ")
+}
+
+func (d Dialect) createTable(table string) []string {
+	columns := "id INTEGER PRIMARY KEY AUTOINCREMENT, topic TEXT NOT NULL, body BLOB NOT NULL, created_at TIMESTAMP NOT NULL, sent_at TIMESTAMP"
+	if d == Postgres {
+		columns = "id BIGSERIAL PRIMARY KEY, topic TEXT NOT NULL, body BYTEA NOT NULL, created_at TIMESTAMPTZ NOT NULL, sent_at TIMESTAMPTZ"
+	}
+
+	return []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table, columns),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_unsent ON %s (id) WHERE sent_at IS NULL", table, table),
+	}
+}
+
+func (d Dialect) createInboxTable(table string) string {
+	columns := "id TEXT PRIMARY KEY, processed_at TIMESTAMP NOT NULL"
+	if d == Postgres {
+		columns = "id TEXT PRIMARY KEY, processed_at TIMESTAMPTZ NOT NULL"
+	}
+
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table, columns)
+}
+
+// lockClause returns the clause locking the selected rows, so concurrent relays
+// don't publish the same rows.
+func (d Dialect) lockClause() string {
+	if d == Postgres {
+		return " FOR UPDATE SKIP LOCKED"
+	}
+
+	return ""
+}
@@ -0,0 +1,61 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Inbox is a bus.Deduplicator recording the processed message UUIDs in an inbox table,
+// so duplicates are detected across listener processes and restarts. Listeners scope
+// the recorded ids by channel, so channels can share the same inbox table.
+type Inbox struct {
+	db      *sql.DB
+	dialect Dialect
+	table   string
+}
+
+// NewInbox returns a new Inbox storing the processed message UUIDs in db,
+// Config.Table defaults to "bus_inbox".
+func NewInbox(db *sql.DB, c Config) *Inbox {
+	table := c.Table
+	if table == "" {
+		table = "bus_inbox"
+	}
+
+	return &Inbox{db: db, dialect: c.Dialect, table: table}
+}
+
+// CreateTable creates the inbox table if it doesn't exist.
+func (i *Inbox) CreateTable(ctx context.Context) error {
+	_, err := i.db.ExecContext(ctx, i.dialect.createInboxTable(i.table))
+	return err
+}
+
+// Processed implements bus.Deduplicator.
+func (i *Inbox) Processed(ctx context.Context, id string) (bool, error) {
+	var found int
+	err := i.db.QueryRowContext(ctx, "SELECT 1 FROM "+i.table+" WHERE id = "+i.dialect.placeholder(1), id).Scan(&found)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// MarkProcessed implements bus.Deduplicator.
+func (i *Inbox) MarkProcessed(ctx context.Context, id string) error {
+	query := "INSERT INTO " + i.table + " (id, processed_at) VALUES (" + i.dialect.placeholders(1, 2) + ") ON CONFLICT (id) DO NOTHING"
+	_, err := i.db.ExecContext(ctx, query, id, time.Now().UTC())
+	return err
+}
+
+// Purge deletes the UUIDs processed before t, returning the number of deleted rows.
+func (i *Inbox) Purge(ctx context.Context, t time.Time) (int64, error) {
+	res, err := i.db.ExecContext(ctx, "DELETE FROM "+i.table+" WHERE processed_at < "+i.dialect.placeholder(1), t.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
@@ -0,0 +1,67 @@
+// Package outbox implements the transactional outbox pattern, messages are stored
+// in an outbox table within the transaction of the business writes, and a Relay
+// publishes them to nsq once the transaction is committed.
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	bus "github.com/rafaeljesus/nsq-event-bus"
+)
+
+// Outbox stores messages in the outbox table.
+type Outbox struct {
+	dialect Dialect
+	table   string
+}
+
+// New returns a new Outbox configured with the variables from the config parameter.
+func New(c Config) *Outbox {
+	table := c.Table
+	if table == "" {
+		table = "bus_outbox"
+	}
+
+	return &Outbox{dialect: c.Dialect, table: table}
+}
+
+// CreateTable creates the outbox table and its index if they don't exist.
+func (o *Outbox) CreateTable(ctx context.Context, db *sql.DB) error {
+	for _, stmt := range o.dialect.createTable(o.table) {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Store encodes payload into a bus.Message and writes it to the outbox table within tx,
+// the message is published to topic by the Relay once tx is committed. The message carries
+// the trace context of ctx, consumer spans are children of the span storing the message.
+func (o *Outbox) Store(ctx context.Context, tx *sql.Tx, topic string, payload interface{}) error {
+	if len(topic) == 0 {
+		return bus.ErrTopicRequired
+	}
+
+	p, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	m := bus.NewMessage(p, "")
+	m.Type = bus.TypeName(payload)
+	bus.InjectTraceContext(ctx, m)
+
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	query := "INSERT INTO " + o.table + " (topic, body, created_at) VALUES (" + o.dialect.placeholders(1, 3) + ")"
+	_, err = tx.ExecContext(ctx, query, topic, body, time.Now().UTC())
+	return err
+}
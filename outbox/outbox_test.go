@@ -0,0 +1,376 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	bus "github.com/rafaeljesus/nsq-event-bus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestOutbox(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		scenario string
+		function func(*testing.T)
+	}{
+		{
+			"store within transaction",
+			testOutboxStore,
+		},
+		{
+			"relay publishes in order",
+			testRelayPoll,
+		},
+		{
+			"relay publish failure",
+			testRelayPublishFailure,
+		},
+		{
+			"relay start and stop",
+			testRelayStartStop,
+		},
+		{
+			"relay logs failed polls",
+			testRelayLogger,
+		},
+		{
+			"inbox deduplicator",
+			testInbox,
+		},
+		{
+			"dialects",
+			testDialects,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			test.function(t)
+		})
+	}
+}
+
+func testOutboxStore(t *testing.T) {
+	db, outbox := newSQLiteOutbox(t)
+	ctx := context.Background()
+
+	store := func(payload string, commit bool) {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("expected to begin transaction %v", err)
+		}
+
+		if err := outbox.Store(ctx, tx, "orders", payload); err != nil {
+			t.Fatalf("expected to store message %v", err)
+		}
+
+		if commit {
+			err = tx.Commit()
+		} else {
+			err = tx.Rollback()
+		}
+		if err != nil {
+			t.Fatalf("expected to end transaction %v", err)
+		}
+	}
+
+	store("created", true)
+	store("cancelled", false)
+
+	var topic string
+	var body []byte
+	if err := db.QueryRow("SELECT topic, body FROM bus_outbox").Scan(&topic, &body); err != nil {
+		t.Fatalf("expected a single stored message %v", err)
+	}
+
+	m := bus.Message{}
+	if err := json.Unmarshal(body, &m); err != nil {
+		t.Fatalf("expected to decode message %v", err)
+	}
+
+	if topic != "orders" || string(m.Payload) != `"created"` {
+		t.Errorf("unexpected stored message %s %s", topic, body)
+	}
+
+	tx, _ := db.Begin()
+	defer tx.Rollback()
+	if err := outbox.Store(ctx, tx, "", "event"); err != bus.ErrTopicRequired {
+		t.Errorf("unexpected error value %v", err)
+	}
+
+	tp := sdktrace.NewTracerProvider()
+	spanCtx, span := tp.Tracer("test").Start(ctx, "checkout")
+	defer span.End()
+
+	if err := outbox.Store(spanCtx, tx, "invoices", orderPlaced{ID: "1"}); err != nil {
+		t.Fatalf("expected to store message %v", err)
+	}
+
+	if err := tx.QueryRow("SELECT body FROM bus_outbox WHERE topic = 'invoices'").Scan(&body); err != nil {
+		t.Fatalf("expected stored message %v", err)
+	}
+
+	m = bus.Message{}
+	if err := json.Unmarshal(body, &m); err != nil || m.Type != bus.TypeName(orderPlaced{}) || m.Type == "" {
+		t.Errorf("expected stored message to carry the payload type %s", body)
+	}
+
+	if !strings.Contains(m.Headers["traceparent"], span.SpanContext().TraceID().String()) {
+		t.Errorf("expected stored message to carry the trace context %v", m.Headers)
+	}
+}
+
+type orderPlaced struct {
+	ID string `json:"id"`
+}
+
+func testRelayPoll(t *testing.T) {
+	db, outbox := newSQLiteOutbox(t)
+	storeAll(t, db, outbox, "orders:1", "orders:2", "users:3", "orders:4")
+
+	publisher := &publisherMock{}
+	relay := NewRelay(db, outbox, publisher, RelayConfig{BatchSize: 3})
+
+	n, err := relay.Poll(context.Background())
+	if err != nil || n != 3 {
+		t.Fatalf("expected to relay a batch %d %v", n, err)
+	}
+
+	n, err = relay.Poll(context.Background())
+	if err != nil || n != 1 {
+		t.Fatalf("expected to relay remaining messages %d %v", n, err)
+	}
+
+	if n, _ := relay.Poll(context.Background()); n != 0 {
+		t.Errorf("expected sent messages not to be relayed again %d", n)
+	}
+
+	if fmt.Sprint(publisher.calls()) != "[orders:[1 2] users:[3] orders:[4]]" {
+		t.Errorf("unexpected publishes %v", publisher.calls())
+	}
+}
+
+func testRelayPublishFailure(t *testing.T) {
+	db, outbox := newSQLiteOutbox(t)
+	storeAll(t, db, outbox, "orders:1", "users:2", "orders:3")
+
+	publisher := &publisherMock{fail: "users"}
+	relay := NewRelay(db, outbox, publisher, RelayConfig{})
+
+	n, err := relay.Poll(context.Background())
+	if err == nil || n != 1 {
+		t.Fatalf("expected relay to stop at the failed publish %d %v", n, err)
+	}
+
+	publisher.setFail("")
+	if n, err := relay.Poll(context.Background()); err != nil || n != 2 {
+		t.Fatalf("expected to relay remaining messages %d %v", n, err)
+	}
+
+	if fmt.Sprint(publisher.calls()) != "[orders:[1] users:[2] orders:[3]]" {
+		t.Errorf("unexpected publishes %v", publisher.calls())
+	}
+}
+
+func testRelayStartStop(t *testing.T) {
+	db, outbox := newSQLiteOutbox(t)
+	storeAll(t, db, outbox, "orders:1", "orders:2", "orders:3")
+
+	publisher := &publisherMock{}
+	relay := NewRelay(db, outbox, publisher, RelayConfig{Interval: time.Millisecond * 10, BatchSize: 2})
+
+	// stopping a relay not started is a no-op
+	relay.Stop()
+
+	relay.Start()
+
+	deadline := time.Now().Add(time.Second)
+	for len(publisher.calls()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+	relay.Stop()
+	relay.Stop()
+
+	if fmt.Sprint(publisher.calls()) != "[orders:[1 2] orders:[3]]" {
+		t.Errorf("unexpected publishes %v", publisher.calls())
+	}
+}
+
+func testRelayLogger(t *testing.T) {
+	db, outbox := newSQLiteOutbox(t)
+	storeAll(t, db, outbox, "orders:1")
+
+	logger := &loggerMock{}
+	relay := NewRelay(db, outbox, &publisherMock{fail: "orders"}, RelayConfig{Interval: time.Millisecond * 10, Logger: logger})
+	relay.Start()
+
+	deadline := time.Now().Add(time.Second)
+	for len(logger.errors()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+	relay.Stop()
+
+	if errs := logger.errors(); len(errs) == 0 || errs[0] != "failed to relay outbox messages" {
+		t.Errorf("expected failed poll to be logged %v", errs)
+	}
+}
+
+func testInbox(t *testing.T) {
+	db, _ := newSQLiteOutbox(t)
+	ctx := context.Background()
+
+	inbox := NewInbox(db, Config{Dialect: SQLite})
+	if err := inbox.CreateTable(ctx); err != nil {
+		t.Fatalf("expected to create inbox table %v", err)
+	}
+
+	// listeners pass ids scoped by their channel
+	for i := 0; i < 2; i++ {
+		if err := inbox.MarkProcessed(ctx, "billing:a"); err != nil {
+			t.Fatalf("expected to mark id processed %v", err)
+		}
+	}
+
+	expected := map[string]bool{"billing:a": true, "billing:b": false, "shipping:a": false}
+	for id, processed := range expected {
+		if dup, err := inbox.Processed(ctx, id); err != nil || dup != processed {
+			t.Errorf("%s: unexpected processed %v %v", id, dup, err)
+		}
+	}
+
+	if err := inbox.MarkProcessed(ctx, "shipping:a"); err != nil {
+		t.Fatalf("expected to mark id processed on another channel %v", err)
+	}
+
+	if n, err := inbox.Purge(ctx, time.Now().Add(time.Minute)); err != nil || n != 2 {
+		t.Errorf("expected to purge processed ids %d %v", n, err)
+	}
+
+	if dup, _ := inbox.Processed(ctx, "billing:a"); dup {
+		t.Error("expected purged id not to be processed")
+	}
+}
+
+func testDialects(t *testing.T) {
+	if p := Postgres.placeholders(2, 3); p != "$2, $3, $4" {
+		t.Errorf("unexpected postgres placeholders %s", p)
+	}
+
+	if p := SQLite.placeholders(2, 3); p != "?, ?, ?" {
+		t.Errorf("unexpected sqlite placeholders %s", p)
+	}
+
+	if Postgres.lockClause() != " FOR UPDATE SKIP LOCKED" || SQLite.lockClause() != "" {
+		t.Error("unexpected lock clauses")
+	}
+}
+
+func newSQLiteOutbox(t *testing.T) (*sql.DB, *Outbox) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "outbox.db"))
+	if err != nil {
+		t.Fatalf("expected to open database %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	outbox := New(Config{Dialect: SQLite})
+	if err := outbox.CreateTable(context.Background(), db); err != nil {
+		t.Fatalf("expected to create outbox table %v", err)
+	}
+
+	return db, outbox
+}
+
+// storeAll stores messages given as "topic:payload" in a single transaction.
+func storeAll(t *testing.T, db *sql.DB, outbox *Outbox, messages ...string) {
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("expected to begin transaction %v", err)
+	}
+
+	for _, message := range messages {
+		parts := strings.SplitN(message, ":", 2)
+		if err := outbox.Store(context.Background(), tx, parts[0], parts[1]); err != nil {
+			t.Fatalf("expected to store message %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("expected to commit transaction %v", err)
+	}
+}
+
+type publisherMock struct {
+	mu        sync.Mutex
+	fail      string
+	published []string
+}
+
+func (p *publisherMock) MultiPublish(topic string, bodies [][]byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if topic == p.fail {
+		return errors.New("publish failed")
+	}
+
+	var payloads []string
+	for _, body := range bodies {
+		m := bus.Message{}
+		json.Unmarshal(body, &m)
+		var payload string
+		json.Unmarshal(m.Payload, &payload)
+		payloads = append(payloads, payload)
+	}
+
+	p.published = append(p.published, fmt.Sprintf("%s:%v", topic, payloads))
+	return nil
+}
+
+func (p *publisherMock) setFail(topic string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fail = topic
+}
+
+func (p *publisherMock) calls() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.published...)
+}
+
+type loggerMock struct {
+	mu     sync.Mutex
+	logged []string
+}
+
+func (l *loggerMock) Debug(msg string, keyvals ...interface{}) {}
+func (l *loggerMock) Info(msg string, keyvals ...interface{})  {}
+func (l *loggerMock) Warn(msg string, keyvals ...interface{})  {}
+func (l *loggerMock) Error(msg string, keyvals ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logged = append(l.logged, msg)
+}
+
+func (l *loggerMock) errors() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.logged...)
+}
+
+var (
+	_ Publisher        = (*bus.Emitter)(nil)
+	_ bus.Deduplicator = (*Inbox)(nil)
+)
@@ -0,0 +1,198 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	bus "github.com/rafaeljesus/nsq-event-bus"
+)
+
+type (
+	// Publisher publishes encoded messages to a topic in a single round trip,
+	// *bus.Emitter implements Publisher.
+	Publisher interface {
+		MultiPublish(topic string, bodies [][]byte) error
+	}
+
+	// Relay polls the outbox table and publishes the unsent messages in order,
+	// messages are marked sent once nsqd acknowledged them.
+	Relay struct {
+		db        *sql.DB
+		outbox    *Outbox
+		publisher Publisher
+		interval  time.Duration
+		batchSize int
+		onError   func(error)
+
+		stop chan struct{}
+		done chan struct{}
+	}
+
+	row struct {
+		id    int64
+		topic string
+		body  []byte
+	}
+)
+
+// NewRelay returns a new Relay publishing the messages of outbox stored in db with publisher.
+func NewRelay(db *sql.DB, outbox *Outbox, publisher Publisher, rc RelayConfig) *Relay {
+	interval := rc.Interval
+	if interval == 0 {
+		interval = time.Second
+	}
+
+	batchSize := rc.BatchSize
+	if batchSize == 0 {
+		batchSize = 100
+	}
+
+	logger := rc.Logger
+	if logger == nil {
+		logger = bus.NewStdLogger()
+	}
+
+	onError := rc.OnError
+	if onError == nil {
+		onError = func(err error) {
+			logger.Error("failed to relay outbox messages", "error", err)
+		}
+	}
+
+	return &Relay{
+		db:        db,
+		outbox:    outbox,
+		publisher: publisher,
+		interval:  interval,
+		batchSize: batchSize,
+		onError:   onError,
+	}
+}
+
+// Start polls the outbox table every Interval until Stop is called, polls are
+// repeated without waiting while full batches are read.
+func (r *Relay) Start() {
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			n, err := r.Poll(context.Background())
+			if err != nil {
+				r.onError(err)
+			}
+
+			if err == nil && n == r.batchSize {
+				select {
+				case <-r.stop:
+					return
+				default:
+					continue
+				}
+			}
+
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops polling the outbox table, it blocks until the running poll returns.
+// Stop does nothing if the relay was not started.
+func (r *Relay) Stop() {
+	if r.stop == nil {
+		return
+	}
+
+	close(r.stop)
+	<-r.done
+	r.stop = nil
+}
+
+// Poll reads up to BatchSize unsent messages, publishes each run of consecutive messages
+// of the same topic with a single MultiPublish and marks them sent. It returns the number
+// of messages sent, messages following a failed publish are retried by the next poll.
+func (r *Relay) Poll(ctx context.Context) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := r.unsent(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for len(rows) > 0 {
+		n := 1
+		for n < len(rows) && rows[n].topic == rows[0].topic {
+			n++
+		}
+
+		bodies := make([][]byte, n)
+		ids := make([]interface{}, n)
+		for i, row := range rows[:n] {
+			bodies[i] = row.body
+			ids[i] = row.id
+		}
+
+		if err := r.publisher.MultiPublish(rows[0].topic, bodies); err != nil {
+			if cerr := tx.Commit(); cerr != nil {
+				return 0, cerr
+			}
+			return sent, err
+		}
+
+		if err := r.markSent(ctx, tx, ids); err != nil {
+			return 0, err
+		}
+
+		sent += n
+		rows = rows[n:]
+	}
+
+	return sent, tx.Commit()
+}
+
+func (r *Relay) unsent(ctx context.Context, tx *sql.Tx) ([]row, error) {
+	o := r.outbox
+	query := "SELECT id, topic, body FROM " + o.table + " WHERE sent_at IS NULL ORDER BY id LIMIT " +
+		o.dialect.placeholder(1) + o.dialect.lockClause()
+
+	rows, err := tx.QueryContext(ctx, query, r.batchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var unsent []row
+	for rows.Next() {
+		var u row
+		if err := rows.Scan(&u.id, &u.topic, &u.body); err != nil {
+			return nil, err
+		}
+		unsent = append(unsent, u)
+	}
+
+	return unsent, rows.Err()
+}
+
+func (r *Relay) markSent(ctx context.Context, tx *sql.Tx, ids []interface{}) error {
+	o := r.outbox
+	query := "UPDATE " + o.table + " SET sent_at = " + o.dialect.placeholder(1) +
+		" WHERE id IN (" + o.dialect.placeholders(2, len(ids)) + ")"
+
+	_, err := tx.ExecContext(ctx, query, append([]interface{}{time.Now().UTC()}, ids...)...)
+	return err
+}
@@ -0,0 +1,119 @@
+package bus
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket, tokens are reserved ahead of the bucket being refilled
+// so the callers waiting for tokens are served in order.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	// onThrottle is called whenever callers start waiting for tokens, with true, and
+	// once the bucket is full again, with false.
+	onThrottle func(throttled bool)
+
+	mu        sync.Mutex
+	tokens    float64
+	last      time.Time
+	throttled bool
+}
+
+func newRateLimiter(rl RateLimit, onThrottle func(throttled bool)) *rateLimiter {
+	if rl.Rate <= 0 {
+		return nil
+	}
+
+	burst := float64(rl.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:       rl.Rate,
+		burst:      burst,
+		onThrottle: onThrottle,
+		tokens:     burst,
+		last:       time.Now(),
+	}
+}
+
+// wait blocks until n tokens are available or ctx is done, a nil rateLimiter never blocks.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	d := l.reserve(n)
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens += float64(n)
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// reserve takes n tokens and returns how long to wait until they are refilled.
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	full := l.tokens >= l.burst
+	l.tokens -= float64(n)
+
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+
+	changed := false
+	if d > 0 && !l.throttled || d <= 0 && l.throttled && full {
+		l.throttled = d > 0
+		changed = true
+	}
+	throttled := l.throttled
+
+	l.mu.Unlock()
+
+	if changed && l.onThrottle != nil {
+		l.onThrottle(throttled)
+	}
+
+	return d
+}
+
+// throttledMaxInFlight returns the number of in flight messages the rate handles
+// within half of the message timeout, bounded by maxInFlight.
+func throttledMaxInFlight(rl RateLimit, maxInFlight int, msgTimeout time.Duration) int {
+	if msgTimeout <= 0 {
+		msgTimeout = defaultMsgTimeout
+	}
+
+	n := int(rl.Rate * msgTimeout.Seconds() / 2)
+	if n > maxInFlight {
+		n = maxInFlight
+	}
+
+	if n < 1 {
+		n = 1
+	}
+
+	return n
+}
@@ -0,0 +1,195 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		scenario string
+		function func(*testing.T)
+	}{
+		{
+			"token bucket",
+			testRateLimitBucket,
+		},
+		{
+			"cancelled wait",
+			testRateLimitCancel,
+		},
+		{
+			"throttled max in flight",
+			testRateLimitMaxInFlight,
+		},
+		{
+			"handler waits for tokens",
+			testRateLimitHandler,
+		},
+		{
+			"listener lowers max in flight",
+			testRateLimitListener,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			test.function(t)
+		})
+	}
+}
+
+func testRateLimitBucket(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		changes []bool
+	)
+	l := newRateLimiter(RateLimit{Rate: 100, Burst: 2}, func(throttled bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, throttled)
+	})
+
+	for i := 0; i < 2; i++ {
+		if d := l.reserve(1); d > 0 {
+			t.Fatalf("expected burst to be served without waiting, got %v", d)
+		}
+	}
+
+	if d := l.reserve(1); d <= 0 || d > time.Millisecond*10 {
+		t.Errorf("expected to wait up to 10ms, got %v", d)
+	}
+
+	time.Sleep(time.Millisecond * 60)
+	if d := l.reserve(1); d > 0 {
+		t.Errorf("expected refilled bucket to be served without waiting, got %v", d)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(changes) != "[true false]" {
+		t.Errorf("expected to be throttled then restored, got %v", changes)
+	}
+
+	if newRateLimiter(RateLimit{}, nil) != nil {
+		t.Error("expected rate limit without Rate to be disabled")
+	}
+
+	var disabled *rateLimiter
+	if err := disabled.wait(context.Background(), 1); err != nil {
+		t.Errorf("expected disabled rate limit not to wait %v", err)
+	}
+}
+
+func testRateLimitCancel(t *testing.T) {
+	l := newRateLimiter(RateLimit{Rate: 1}, nil)
+	l.reserve(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if err := l.wait(ctx, 1); err != context.DeadlineExceeded {
+		t.Fatalf("expected wait to be cancelled, got %v", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.tokens < -0.1 {
+		t.Errorf("expected cancelled tokens to be given back, got %v", l.tokens)
+	}
+}
+
+func testRateLimitMaxInFlight(t *testing.T) {
+	cases := []struct {
+		rate        float64
+		maxInFlight int
+		msgTimeout  time.Duration
+		expected    int
+	}{
+		{10, 100, time.Second * 4, 20},
+		{10, 5, time.Second * 4, 5},
+		{0.1, 100, time.Second * 4, 1},
+		{1, 100, 0, 30},
+	}
+
+	for _, c := range cases {
+		if n := throttledMaxInFlight(RateLimit{Rate: c.rate}, c.maxInFlight, c.msgTimeout); n != c.expected {
+			t.Errorf("rate %v: expected max in flight %d, got %d", c.rate, c.expected, n)
+		}
+	}
+}
+
+func testRateLimitHandler(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		handled int
+	)
+	h := newHandler(context.Background(), ListenerConfig{
+		HandlerFunc: func(ctx context.Context, message *Message) (reply interface{}, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			handled++
+			return
+		},
+	})
+	h.limiter = newRateLimiter(RateLimit{Rate: 50}, nil)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := h.HandleMessage(newNSQMessage(t, NewMessage([]byte(`{}`), ""))); err != nil {
+			t.Fatalf("expected to handle message %v", err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < time.Millisecond*35 {
+		t.Errorf("expected messages to be throttled, handled in %v", elapsed)
+	}
+
+	if handled != 3 {
+		t.Errorf("expected 3 handled messages, got %d", handled)
+	}
+}
+
+func testRateLimitListener(t *testing.T) {
+	lookupd := newTopicsLookupdMock(nil)
+	defer lookupd.Close()
+
+	l, err := NewListener(ListenerConfig{
+		Topic:       "orders",
+		Channel:     "billing",
+		Lookup:      []string{serverAddress(lookupd)},
+		MaxInFlight: 100,
+		MsgTimeout:  time.Second * 4,
+		RateLimit:   RateLimit{Rate: 5},
+		Logger:      &loggerMock{},
+		HandlerFunc: func(ctx context.Context, message *Message) (reply interface{}, err error) {
+			return
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected to create listener %v", err)
+	}
+	defer l.Stop()
+
+	l.limiter.reserve(1)
+	l.limiter.reserve(1)
+	if n := l.currentMaxInFlight(); n != 10 {
+		t.Errorf("expected throttled max in flight to be 10, got %d", n)
+	}
+
+	time.Sleep(time.Millisecond * 500)
+	l.limiter.reserve(1)
+	if n := l.currentMaxInFlight(); n != 100 {
+		t.Errorf("expected max in flight to be restored, got %d", n)
+	}
+}
+
+func (l *Listener) currentMaxInFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.maxInFlight()
+}
@@ -0,0 +1,109 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+// retryableErrors are the nsqd error codes returned when nsqd failed to accept a
+// valid message, publishing it again may succeed.
+var retryableErrors = []string{"E_PUB_FAILED", "E_MPUB_FAILED", "E_DPUB_FAILED"}
+
+// IsRetryableError reports whether err is a transient publish failure: a network
+// error, a connection closed or reset, or nsqd failing to accept the message.
+// Validation errors, open circuit breakers and context errors are not retryable.
+func IsRetryableError(err error) bool {
+	if perr, ok := err.(nsq.ErrProtocol); ok {
+		for _, code := range retryableErrors {
+			if strings.HasPrefix(perr.Reason, code) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case err == nil,
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return false
+	case err == nsq.ErrNotConnected,
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.EPIPE):
+		return true
+	}
+
+	var nerr net.Error
+	return errors.As(err, &nerr)
+}
+
+// do calls attempt until it succeeds, MaxAttempts is reached, the error is not
+// retryable or ctx is done, onRetry is called before waiting for each retry.
+func (p RetryPolicy) do(ctx context.Context, attempt func() error, onRetry func(attempt int, err error, wait time.Duration)) error {
+	for n := 1; ; n++ {
+		err := attempt()
+		if err == nil || n >= p.MaxAttempts || !p.isRetryable(err) {
+			return err
+		}
+
+		wait := p.backoff(n)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return err
+		}
+
+		onRetry(n, err, wait)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+func (p RetryPolicy) isRetryable(err error) bool {
+	if p.IsRetryable != nil {
+		return p.IsRetryable(err)
+	}
+
+	return IsRetryableError(err)
+}
+
+// backoff returns the delay before retrying the nth attempt.
+func (p RetryPolicy) backoff(n int) time.Duration {
+	initial := p.InitialBackoff
+	if initial == 0 {
+		initial = time.Millisecond * 100
+	}
+
+	max := p.MaxBackoff
+	if max == 0 {
+		max = time.Second * 5
+	}
+
+	multiplier := p.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+
+	wait := math.Min(float64(initial)*math.Pow(multiplier, float64(n-1)), float64(max))
+	if p.Jitter > 0 {
+		wait -= wait * math.Min(p.Jitter, 1) * rand.Float64()
+	}
+
+	return time.Duration(wait)
+}
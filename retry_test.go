@@ -0,0 +1,166 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/sony/gobreaker"
+)
+
+func TestRetry(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		scenario string
+		function func(*testing.T)
+	}{
+		{
+			"retryable errors",
+			testIsRetryableError,
+		},
+		{
+			"backoff",
+			testRetryBackoff,
+		},
+		{
+			"attempts",
+			testRetryAttempts,
+		},
+		{
+			"context deadline",
+			testRetryContext,
+		},
+		{
+			"emitter retries within breaker",
+			testEmitterRetry,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			test.function(t)
+		})
+	}
+}
+
+func testIsRetryableError(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected bool
+	}{
+		{nsq.ErrProtocol{Reason: "E_PUB_FAILED PUB failed"}, true},
+		{nsq.ErrProtocol{Reason: "E_BAD_MESSAGE PUB message too big"}, false},
+		{nsq.ErrNotConnected, true},
+		{fmt.Errorf("write: %w", syscall.ECONNRESET), true},
+		{io.EOF, true},
+		{gobreaker.ErrOpenState, false},
+		{context.DeadlineExceeded, false},
+		{errors.New("unknown"), false},
+	}
+
+	for _, c := range cases {
+		if retryable := IsRetryableError(c.err); retryable != c.expected {
+			t.Errorf("%v: unexpected retryable %v", c.err, retryable)
+		}
+	}
+}
+
+func testRetryBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: time.Millisecond * 10, MaxBackoff: time.Millisecond * 50}
+	var waits []time.Duration
+	for n := 1; n <= 4; n++ {
+		waits = append(waits, p.backoff(n))
+	}
+
+	if fmt.Sprint(waits) != "[10ms 20ms 40ms 50ms]" {
+		t.Errorf("unexpected backoff %v", waits)
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if wait := p.backoff(2); wait < time.Millisecond*10 || wait > time.Millisecond*20 {
+			t.Fatalf("unexpected jittered backoff %v", wait)
+		}
+	}
+}
+
+func testRetryAttempts(t *testing.T) {
+	cases := []struct {
+		msg      string
+		policy   RetryPolicy
+		errs     []error
+		attempts int
+	}{
+		{"no retries by default", RetryPolicy{}, []error{nsq.ErrNotConnected}, 1},
+		{"retry until success", RetryPolicy{MaxAttempts: 5}, []error{nsq.ErrNotConnected, io.EOF, nil}, 3},
+		{"retry up to max attempts", RetryPolicy{MaxAttempts: 2}, []error{nsq.ErrNotConnected, nsq.ErrNotConnected, nil}, 2},
+		{"non retryable error", RetryPolicy{MaxAttempts: 5}, []error{gobreaker.ErrOpenState, nil}, 1},
+		{"custom classifier", RetryPolicy{MaxAttempts: 5, IsRetryable: func(error) bool { return true }}, []error{gobreaker.ErrOpenState, nil}, 2},
+	}
+
+	for _, c := range cases {
+		c.policy.InitialBackoff = time.Millisecond
+		attempts := 0
+		c.policy.do(context.Background(), func() error {
+			err := c.errs[attempts]
+			attempts++
+			return err
+		}, func(int, error, time.Duration) {})
+
+		if attempts != c.attempts {
+			t.Errorf("%s: unexpected attempts %d", c.msg, attempts)
+		}
+	}
+}
+
+func testRetryContext(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Millisecond * 20}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	attempts := 0
+	err := p.do(ctx, func() error {
+		attempts++
+		return nsq.ErrNotConnected
+	}, func(int, error, time.Duration) {})
+
+	if err != nsq.ErrNotConnected || attempts != 2 {
+		t.Errorf("expected retries to stop before the deadline %d %v", attempts, err)
+	}
+}
+
+func testEmitterRetry(t *testing.T) {
+	logger := &loggerMock{}
+	emitter, err := NewEmitter(EmitterConfig{
+		Address:  "127.0.0.1:1",
+		Logger:   logger,
+		LogLevel: LogDebug,
+		Breaker:  Breaker{Threshold: 1},
+		Retry:    RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("expected to initialize emitter %v", err)
+	}
+	defer emitter.Stop()
+
+	if err := emitter.Emit("orders", "event"); err != gobreaker.ErrOpenState {
+		t.Errorf("expected retries to stop once the breaker is open %v", err)
+	}
+
+	retries := 0
+	for _, msg := range logger.entries() {
+		if msg == "retrying publish" {
+			retries++
+		}
+	}
+
+	if retries != 2 {
+		t.Errorf("unexpected retries %d", retries)
+	}
+}
@@ -0,0 +1,123 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Router dispatches the messages of a topic to the handler registered for their Type,
+// its Route method is a HandlerFunc for ListenerConfig.
+type Router struct {
+	mu       sync.RWMutex
+	handlers map[string]HandlerFunc
+	fallback HandlerFunc
+}
+
+// NewRouter returns a new Router, messages of unregistered types are finished
+// without being handled unless a Fallback is set.
+func NewRouter() *Router {
+	return &Router{handlers: make(map[string]HandlerFunc)}
+}
+
+// Handle registers h for the messages of type name.
+func (r *Router) Handle(name string, h HandlerFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.handlers[name] = h
+}
+
+// Register registers fn for the messages whose Type is the TypeName of T, fn must be
+// a func(context.Context, *T) (interface{}, error) or func(context.Context, T) (interface{}, error),
+// the payload is decoded into T before calling fn. Register panics if fn has another signature.
+func (r *Router) Register(fn interface{}) {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 2 || t.NumOut() != 2 ||
+		t.In(0) != contextType || t.Out(0).Kind() != reflect.Interface || t.Out(1) != errorType {
+		panic(fmt.Sprintf("bus: Register expects func(context.Context, T) (interface{}, error), got %s", t))
+	}
+
+	arg := t.In(1)
+	elem := arg
+	if arg.Kind() == reflect.Ptr {
+		elem = arg.Elem()
+	}
+
+	name := namedType(elem)
+	if name == "" {
+		panic(fmt.Sprintf("bus: Register expects a named payload type, got %s", arg))
+	}
+
+	r.Handle(name, func(ctx context.Context, m *Message) (interface{}, error) {
+		payload := reflect.New(elem)
+		if err := m.DecodePayload(payload.Interface()); err != nil {
+			return nil, err
+		}
+
+		if arg.Kind() != reflect.Ptr {
+			payload = payload.Elem()
+		}
+
+		out := v.Call([]reflect.Value{reflect.ValueOf(ctx), payload})
+		err, _ := out[1].Interface().(error)
+		return out[0].Interface(), err
+	})
+}
+
+// Fallback sets the handler of the messages whose Type has no registered handler.
+func (r *Router) Fallback(h HandlerFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.fallback = h
+}
+
+// Route is a HandlerFunc calling the handler registered for the message Type.
+func (r *Router) Route(ctx context.Context, m *Message) (interface{}, error) {
+	r.mu.RLock()
+	h, ok := r.handlers[m.Type]
+	if !ok {
+		h = r.fallback
+	}
+	r.mu.RUnlock()
+
+	if h == nil {
+		return nil, nil
+	}
+
+	return h(ctx, m)
+}
+
+// TypeName returns the Type messages of payload v default to, the package qualified
+// name of the Go type of v dereferencing pointers, e.g. "github.com/acme/orders.OrderCreated",
+// or an empty string for unnamed and predeclared types.
+func TypeName(v interface{}) string {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == nil {
+		return ""
+	}
+
+	return namedType(t)
+}
+
+// namedType returns the package qualified name of t if it is declared in a package,
+// so that same named types of different packages are told apart.
+func namedType(t reflect.Type) string {
+	if t.PkgPath() == "" || t.Name() == "" {
+		return ""
+	}
+
+	return t.PkgPath() + "." + t.Name()
+}
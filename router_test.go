@@ -0,0 +1,179 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type orderCreated struct {
+	ID string `json:"id"`
+}
+
+type orderCanceled struct {
+	ID string `json:"id"`
+}
+
+func TestRouter(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		scenario string
+		function func(*testing.T)
+	}{
+		{
+			"type from payload",
+			testRouterTypeName,
+		},
+		{
+			"type set on emit",
+			testRouterWithType,
+		},
+		{
+			"routes to typed handlers",
+			testRouterRoute,
+		},
+		{
+			"fallback for unknown types",
+			testRouterFallback,
+		},
+		{
+			"invalid handler signature",
+			testRouterRegisterInvalid,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			test.function(t)
+		})
+	}
+}
+
+func testRouterTypeName(t *testing.T) {
+	pkg := reflect.TypeOf(orderCreated{}).PkgPath()
+	cases := []struct {
+		payload interface{}
+		name    string
+	}{
+		{orderCreated{}, pkg + ".orderCreated"},
+		{&orderCreated{}, pkg + ".orderCreated"},
+		{time.Duration(0), "time.Duration"},
+		{"created", ""},
+		{map[string]string{}, ""},
+		{nil, ""},
+	}
+
+	for _, c := range cases {
+		if name := TypeName(c.payload); name != c.name {
+			t.Errorf("expected type name of %T to be %q, got %q", c.payload, c.name, name)
+		}
+	}
+}
+
+func testRouterWithType(t *testing.T) {
+	m := &Message{Type: "orderCreated"}
+	newEmitOptions(nil).apply(m)
+	if m.Type != "orderCreated" {
+		t.Errorf("expected type to be kept, got %q", m.Type)
+	}
+
+	newEmitOptions([]EmitOption{WithType("order.created")}).apply(m)
+	if m.Type != "order.created" {
+		t.Errorf("expected type to be overridden, got %q", m.Type)
+	}
+}
+
+func testRouterRoute(t *testing.T) {
+	router := NewRouter()
+	router.Register(func(ctx context.Context, e *orderCreated) (interface{}, error) {
+		return "created " + e.ID, nil
+	})
+	router.Register(func(ctx context.Context, e orderCanceled) (interface{}, error) {
+		return "canceled " + e.ID, nil
+	})
+	router.Handle("order.shipped", func(ctx context.Context, m *Message) (interface{}, error) {
+		return "shipped", nil
+	})
+
+	cases := []struct {
+		payload interface{}
+		typ     string
+		reply   string
+	}{
+		{orderCreated{ID: "1"}, "", "created 1"},
+		{orderCanceled{ID: "2"}, "", "canceled 2"},
+		{orderCreated{ID: "3"}, "order.shipped", "shipped"},
+	}
+
+	for _, c := range cases {
+		m := newTypedMessage(t, c.payload, c.typ)
+		reply, err := router.Route(context.Background(), m)
+		if err != nil {
+			t.Fatalf("expected to route %s %v", m.Type, err)
+		}
+
+		if reply != c.reply {
+			t.Errorf("expected reply %q, got %v", c.reply, reply)
+		}
+	}
+
+	m := &Message{Type: TypeName(orderCreated{}), Payload: []byte(`{`)}
+	if _, err := router.Route(context.Background(), m); err == nil {
+		t.Error("expected invalid payload to fail")
+	}
+}
+
+func testRouterFallback(t *testing.T) {
+	router := NewRouter()
+	m := newTypedMessage(t, orderCreated{ID: "1"}, "")
+
+	reply, err := router.Route(context.Background(), m)
+	if reply != nil || err != nil {
+		t.Errorf("expected unknown type to be ignored, got %v %v", reply, err)
+	}
+
+	router.Fallback(func(ctx context.Context, m *Message) (interface{}, error) {
+		return "unknown " + m.Type, nil
+	})
+
+	reply, err = router.Route(context.Background(), m)
+	if err != nil || reply != "unknown "+TypeName(orderCreated{}) {
+		t.Errorf("expected fallback to handle unknown type, got %v %v", reply, err)
+	}
+}
+
+func testRouterRegisterInvalid(t *testing.T) {
+	fns := []interface{}{
+		"handler",
+		func(e orderCreated) (interface{}, error) { return nil, nil },
+		func(ctx context.Context, e orderCreated) error { return nil },
+		func(ctx context.Context, e string) (interface{}, error) { return nil, nil },
+	}
+
+	for _, fn := range fns {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected Register to panic for %T", fn)
+				}
+			}()
+
+			NewRouter().Register(fn)
+		}()
+	}
+}
+
+func newTypedMessage(t *testing.T, payload interface{}, typ string) *Message {
+	p, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("expected to marshal payload %v", err)
+	}
+
+	m := NewMessage(p, "")
+	m.Type = TypeName(payload)
+	newEmitOptions([]EmitOption{WithType(typ)}).apply(m)
+	return m
+}
@@ -0,0 +1,519 @@
+package bus
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrSpoolFull is returned by Emit when publishing failed and the spool reached SpoolConfig.MaxBytes.
+	ErrSpoolFull = errors.New("spool is full")
+	// ErrSpoolClosed is returned by Emit when publishing failed after the emitter was stopped.
+	ErrSpoolClosed = errors.New("spool is closed")
+)
+
+// FsyncPolicy defines when the spool segment files are synced to disk.
+type FsyncPolicy int
+
+// Fsync policies.
+const (
+	// FsyncInterval syncs the current segment every SpoolConfig.FsyncInterval.
+	FsyncInterval FsyncPolicy = iota
+	// FsyncAlways syncs the current segment after every appended message.
+	FsyncAlways
+	// FsyncNever leaves syncing to the operating system.
+	FsyncNever
+)
+
+const (
+	segmentExt        = ".seg"
+	cursorFile        = "cursor"
+	spoolHeaderSize   = 12
+	defaultSpoolBytes = 1 << 30
+	defaultSegment    = 16 << 20
+)
+
+// spool is an on-disk FIFO of messages made of append-only segment files, each record
+// is the topic and body lengths, the crc32 of topic and body, then topic and body.
+// The position of the next record to drain is kept in the cursor file.
+type spool struct {
+	mu          sync.Mutex
+	dir         string
+	maxBytes    int64
+	segmentSize int64
+	fsync       FsyncPolicy
+
+	segments []uint64
+	size     int64
+	w        *os.File
+	wsize    int64
+
+	r       *os.File
+	rseg    uint64
+	roff    int64
+	pending int64
+	closed  bool
+}
+
+func openSpool(c SpoolConfig) (*spool, error) {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &spool{
+		dir:         c.Dir,
+		maxBytes:    c.MaxBytes,
+		segmentSize: c.SegmentSize,
+		fsync:       c.Fsync,
+	}
+
+	if s.maxBytes == 0 {
+		s.maxBytes = defaultSpoolBytes
+	}
+
+	if s.segmentSize == 0 {
+		s.segmentSize = defaultSegment
+	}
+
+	infos, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		s.segments = append(s.segments, seq)
+		s.size += info.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	if len(s.segments) == 0 {
+		s.segments = []uint64{1}
+	}
+
+	if err := s.readCursor(); err != nil {
+		return nil, err
+	}
+
+	if err := s.openWriter(s.segments[len(s.segments)-1]); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// empty reports whether every spooled message was drained.
+func (s *spool) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.rseg == s.segments[len(s.segments)-1] && s.roff >= s.wsize
+}
+
+// append adds a message to the end of the spool.
+func (s *spool) append(topic string, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrSpoolClosed
+	}
+
+	n := int64(spoolHeaderSize + len(topic) + len(body))
+	if s.size+n > s.maxBytes {
+		return ErrSpoolFull
+	}
+
+	if s.wsize > 0 && s.wsize+n > s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, n)
+	binary.BigEndian.PutUint32(record[0:], uint32(len(topic)))
+	binary.BigEndian.PutUint32(record[4:], uint32(len(body)))
+	copy(record[spoolHeaderSize:], topic)
+	copy(record[spoolHeaderSize+len(topic):], body)
+	binary.BigEndian.PutUint32(record[8:], crc32.ChecksumIEEE(record[spoolHeaderSize:]))
+
+	if _, err := s.w.Write(record); err != nil {
+		return err
+	}
+
+	s.wsize += n
+	s.size += n
+
+	if s.fsync == FsyncAlways {
+		return s.w.Sync()
+	}
+
+	return nil
+}
+
+// peek returns the next message to drain without removing it, ok is false when
+// the spool is empty. A torn record at the end of a segment, left by a crash
+// while appending, is discarded.
+func (s *spool) peek() (topic string, body []byte, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		last := s.rseg == s.segments[len(s.segments)-1]
+		if last && s.roff >= s.wsize {
+			return "", nil, false, nil
+		}
+
+		topic, body, n, err := s.readRecord()
+		if err == nil {
+			s.pending = n
+			return topic, body, true, nil
+		}
+
+		if err != io.EOF && err != io.ErrUnexpectedEOF && err != errCorruptRecord {
+			return "", nil, false, err
+		}
+
+		if last {
+			if err := s.w.Truncate(s.roff); err != nil {
+				return "", nil, false, err
+			}
+			s.size -= s.wsize - s.roff
+			s.wsize = s.roff
+			return "", nil, false, nil
+		}
+
+		if err := s.removeReadSegment(); err != nil {
+			return "", nil, false, err
+		}
+	}
+}
+
+// commit removes the message returned by the last peek.
+func (s *spool) commit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.roff += s.pending
+	s.pending = 0
+
+	last := s.rseg == s.segments[len(s.segments)-1]
+	switch {
+	case last && s.roff >= s.wsize:
+		// the spool is drained, reuse the current segment from its start. The cursor
+		// is persisted first, a crash before the truncate redelivers the drained
+		// messages instead of pointing past the end of the segment.
+		s.roff = 0
+		if err := s.writeCursor(); err != nil {
+			return err
+		}
+		if err := s.w.Truncate(0); err != nil {
+			return err
+		}
+		s.size -= s.wsize
+		s.wsize = 0
+		return nil
+	case !last && s.roff >= s.segmentLen(s.rseg):
+		return s.removeReadSegment()
+	}
+
+	return s.writeCursor()
+}
+
+func (s *spool) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.w.Sync()
+}
+
+func (s *spool) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	if s.r != nil {
+		s.r.Close()
+	}
+
+	if err := s.w.Sync(); err != nil {
+		s.w.Close()
+		return err
+	}
+
+	return s.w.Close()
+}
+
+var errCorruptRecord = errors.New("corrupt spool record")
+
+func (s *spool) readRecord() (string, []byte, int64, error) {
+	if s.r == nil {
+		r, err := os.Open(s.segmentPath(s.rseg))
+		if err != nil {
+			return "", nil, 0, err
+		}
+		s.r = r
+	}
+
+	header := make([]byte, spoolHeaderSize)
+	if _, err := s.r.ReadAt(header, s.roff); err != nil {
+		return "", nil, 0, err
+	}
+
+	topicLen := int64(binary.BigEndian.Uint32(header[0:]))
+	bodyLen := int64(binary.BigEndian.Uint32(header[4:]))
+	if topicLen+bodyLen > s.maxBytes {
+		return "", nil, 0, errCorruptRecord
+	}
+
+	data := make([]byte, topicLen+bodyLen)
+	if _, err := s.r.ReadAt(data, s.roff+spoolHeaderSize); err != nil {
+		return "", nil, 0, err
+	}
+
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[8:]) {
+		return "", nil, 0, errCorruptRecord
+	}
+
+	return string(data[:topicLen]), data[topicLen:], spoolHeaderSize + topicLen + bodyLen, nil
+}
+
+// removeReadSegment deletes the drained segment and moves the cursor to the next one.
+func (s *spool) removeReadSegment() error {
+	if s.r != nil {
+		s.r.Close()
+		s.r = nil
+	}
+
+	s.size -= s.segmentLen(s.rseg)
+	if err := os.Remove(s.segmentPath(s.rseg)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s.segments = s.segments[1:]
+	s.rseg = s.segments[0]
+	s.roff = 0
+	return s.writeCursor()
+}
+
+func (s *spool) rotate() error {
+	if err := s.w.Sync(); err != nil {
+		return err
+	}
+
+	if err := s.w.Close(); err != nil {
+		return err
+	}
+
+	next := s.segments[len(s.segments)-1] + 1
+	s.segments = append(s.segments, next)
+	return s.openWriter(next)
+}
+
+func (s *spool) openWriter(seq uint64) error {
+	w, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := w.Stat()
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	s.w = w
+	s.wsize = info.Size()
+	return nil
+}
+
+func (s *spool) segmentLen(seq uint64) int64 {
+	if seq == s.segments[len(s.segments)-1] {
+		return s.wsize
+	}
+
+	info, err := os.Stat(s.segmentPath(seq))
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
+
+func (s *spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+// readCursor loads the position of the next record to drain, segments before
+// the cursor segment were drained and are removed.
+func (s *spool) readCursor() error {
+	s.rseg = s.segments[0]
+
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, cursorFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var seq uint64
+	var off int64
+	if _, err := fmt.Sscanf(string(b), "%d %d", &seq, &off); err != nil {
+		return nil
+	}
+
+	for len(s.segments) > 1 && s.segments[0] < seq {
+		info, err := os.Stat(s.segmentPath(s.segments[0]))
+		if err == nil {
+			s.size -= info.Size()
+		}
+		if err := os.Remove(s.segmentPath(s.segments[0])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.segments = s.segments[1:]
+	}
+
+	if s.segments[0] == seq {
+		s.rseg = seq
+		s.roff = off
+
+		// an offset past the end of the segment is stale, the segment was reused
+		if info, err := os.Stat(s.segmentPath(seq)); err != nil || off < 0 || off > info.Size() {
+			s.roff = 0
+		}
+	}
+
+	return nil
+}
+
+// writeCursor atomically replaces the cursor file, the new cursor is synced to disk
+// before the rename and the rename is synced with the directory, unless FsyncNever.
+func (s *spool) writeCursor() error {
+	path := filepath.Join(s.dir, cursorFile)
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(f, "%d %d", s.rseg, s.roff); err != nil {
+		f.Close()
+		return err
+	}
+
+	if s.fsync != FsyncNever {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	if s.fsync == FsyncNever {
+		return nil
+	}
+
+	return syncDir(s.dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// drain republishes the spooled messages in order every interval until stop is
+// closed, it stops at the first message failing to publish and retries it later.
+func (e *Emitter) drain(stop <-chan struct{}, done chan<- struct{}, interval, fsyncInterval time.Duration) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var fsync <-chan time.Time
+	if e.spool.fsync == FsyncInterval {
+		t := time.NewTicker(fsyncInterval)
+		defer t.Stop()
+		fsync = t.C
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-fsync:
+			if err := e.spool.sync(); err != nil {
+				e.logger.Error("failed to sync spool", "error", err)
+			}
+		case <-ticker.C:
+			e.drainSpool(stop)
+		}
+	}
+}
+
+func (e *Emitter) drainSpool(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		topic, body, ok, err := e.spool.peek()
+		if err != nil {
+			e.logger.Error("failed to read spool", "error", err)
+			return
+		}
+
+		if !ok {
+			return
+		}
+
+		if err := e.publish(context.Background(), topic, body); err != nil {
+			if e.breakerConfig.isFailure(err) {
+				return
+			}
+			e.logger.Error("dropped spooled message rejected by nsqd", "topic", topic, "error", err)
+		}
+
+		if err := e.spool.commit(); err != nil {
+			e.logger.Error("failed to commit spool", "error", err)
+			return
+		}
+	}
+}
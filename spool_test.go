@@ -0,0 +1,265 @@
+package bus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		scenario string
+		function func(*testing.T)
+	}{
+		{
+			"append and drain in order",
+			testSpoolOrder,
+		},
+		{
+			"reopen resumes from cursor",
+			testSpoolReopen,
+		},
+		{
+			"torn record",
+			testSpoolTornRecord,
+		},
+		{
+			"stale cursor",
+			testSpoolStaleCursor,
+		},
+		{
+			"max bytes",
+			testSpoolFull,
+		},
+		{
+			"emitter spools failed publishes",
+			testSpoolEmitter,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			test.function(t)
+		})
+	}
+}
+
+func testSpoolOrder(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(SpoolConfig{Dir: dir, SegmentSize: 64, Fsync: FsyncAlways})
+	if err != nil {
+		t.Fatalf("expected to open spool %v", err)
+	}
+	defer s.close()
+
+	for i := 0; i < 10; i++ {
+		if err := s.append("orders", []byte(fmt.Sprintf("event-%d", i))); err != nil {
+			t.Fatalf("expected to append message %v", err)
+		}
+	}
+
+	if segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt)); len(segments) < 2 {
+		t.Errorf("expected segments to rotate %v", segments)
+	}
+
+	drained := drainAll(t, s)
+	if fmt.Sprint(drained) != "[orders:event-0 orders:event-1 orders:event-2 orders:event-3 orders:event-4 orders:event-5 orders:event-6 orders:event-7 orders:event-8 orders:event-9]" {
+		t.Errorf("unexpected drained messages %v", drained)
+	}
+
+	if !s.empty() || s.size != 0 {
+		t.Errorf("expected spool to be empty %d", s.size)
+	}
+
+	if segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt)); len(segments) != 1 {
+		t.Errorf("expected drained segments to be removed %v", segments)
+	}
+}
+
+func testSpoolReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(SpoolConfig{Dir: dir, SegmentSize: 64})
+	if err != nil {
+		t.Fatalf("expected to open spool %v", err)
+	}
+
+	for i := 0; i < 6; i++ {
+		s.append("orders", []byte(fmt.Sprintf("event-%d", i)))
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, _, ok, err := s.peek(); !ok || err != nil {
+			t.Fatalf("expected to peek message %v", err)
+		}
+		s.commit()
+	}
+	s.close()
+
+	s, err = openSpool(SpoolConfig{Dir: dir, SegmentSize: 64})
+	if err != nil {
+		t.Fatalf("expected to reopen spool %v", err)
+	}
+	defer s.close()
+
+	s.append("orders", []byte("event-6"))
+	drained := drainAll(t, s)
+	if fmt.Sprint(drained) != "[orders:event-4 orders:event-5 orders:event-6]" {
+		t.Errorf("unexpected drained messages %v", drained)
+	}
+}
+
+func testSpoolTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(SpoolConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("expected to open spool %v", err)
+	}
+	s.append("orders", []byte("event-0"))
+	s.append("orders", []byte("event-1"))
+	s.close()
+
+	path := s.segmentPath(1)
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatalf("expected to truncate segment %v", err)
+	}
+
+	s, err = openSpool(SpoolConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("expected to reopen spool %v", err)
+	}
+	defer s.close()
+
+	drained := drainAll(t, s)
+	if fmt.Sprint(drained) != "[orders:event-0]" {
+		t.Errorf("unexpected drained messages %v", drained)
+	}
+
+	s.append("orders", []byte("event-2"))
+	if drained := drainAll(t, s); fmt.Sprint(drained) != "[orders:event-2]" {
+		t.Errorf("expected torn record to be discarded %v", drained)
+	}
+}
+
+func testSpoolStaleCursor(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(SpoolConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("expected to open spool %v", err)
+	}
+	s.append("orders", []byte("event-0"))
+	drainAll(t, s)
+
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, cursorFile)); string(b) != "1 0" {
+		t.Errorf("expected drained cursor to be persisted %q", b)
+	}
+
+	s.append("orders", []byte("event-1"))
+	s.close()
+
+	// a cursor past the end of the segment, as left by a crash before the drained
+	// segment was reused
+	if err := ioutil.WriteFile(filepath.Join(dir, cursorFile), []byte("1 1000"), 0644); err != nil {
+		t.Fatalf("expected to write cursor %v", err)
+	}
+
+	s, err = openSpool(SpoolConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("expected to reopen spool %v", err)
+	}
+	defer s.close()
+
+	if drained := drainAll(t, s); fmt.Sprint(drained) != "[orders:event-1]" {
+		t.Errorf("expected stale cursor to be reset %v", drained)
+	}
+}
+
+func testSpoolFull(t *testing.T) {
+	s, err := openSpool(SpoolConfig{Dir: t.TempDir(), MaxBytes: 40})
+	if err != nil {
+		t.Fatalf("expected to open spool %v", err)
+	}
+	defer s.close()
+
+	if err := s.append("orders", []byte("event-0")); err != nil {
+		t.Fatalf("expected to append message %v", err)
+	}
+
+	if err := s.append("orders", []byte("event-1")); err != ErrSpoolFull {
+		t.Errorf("expected spool to be full %v", err)
+	}
+}
+
+func testSpoolEmitter(t *testing.T) {
+	dir := t.TempDir()
+	emitter, err := NewEmitter(EmitterConfig{
+		Address:  "127.0.0.1:1",
+		LogLevel: LogError,
+		Spool:    SpoolConfig{Dir: dir},
+	})
+	if err != nil {
+		t.Fatalf("expected to initialize emitter %v", err)
+	}
+
+	for _, event := range []string{"created", "updated"} {
+		if err := emitter.Emit("orders", event); err != nil {
+			t.Fatalf("expected message to be spooled %v", err)
+		}
+	}
+
+	if err := emitter.EmitAsync("orders", "deleted"); err != nil {
+		t.Fatalf("expected message to be spooled %v", err)
+	}
+	emitter.Stop()
+
+	if err := emitter.Emit("orders", "stopped"); err != ErrSpoolClosed {
+		t.Errorf("expected spool to be closed %v", err)
+	}
+
+	s, err := openSpool(SpoolConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("expected to reopen spool %v", err)
+	}
+	defer s.close()
+
+	var payloads []string
+	for _, body := range drainAll(t, s) {
+		payloads = append(payloads, body[len("orders:"):])
+	}
+
+	if len(payloads) != 3 {
+		t.Fatalf("unexpected spooled messages %v", payloads)
+	}
+
+	for i, event := range []string{`"created"`, `"updated"`, `"deleted"`} {
+		m := Message{}
+		if err := json.Unmarshal([]byte(payloads[i]), &m); err != nil || string(m.Payload) != event {
+			t.Errorf("unexpected spooled message %s", payloads[i])
+		}
+	}
+}
+
+// drainAll peeks and commits every spooled message, returning them as "topic:body".
+func drainAll(t *testing.T, s *spool) []string {
+	var drained []string
+	for {
+		topic, body, ok, err := s.peek()
+		if err != nil {
+			t.Fatalf("expected to peek message %v", err)
+		}
+
+		if !ok {
+			return drained
+		}
+
+		drained = append(drained, topic+":"+string(body))
+		if err := s.commit(); err != nil {
+			t.Fatalf("expected to commit message %v", err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrReplyToRequired is returned by Message.Reply when the message is not a request.
+	ErrReplyToRequired = errors.New("reply topic is mandatory")
+	// ErrStreamClosed is returned by Message.Reply once the last reply was sent.
+	ErrStreamClosed = errors.New("reply stream is closed")
+)
+
+// replier sends the replies of a request in sequence.
+type replier struct {
+	mu      sync.Mutex
+	ctx     context.Context
+	emitter *Emitter
+	topic   string
+	seq     int
+	closed  bool
+}
+
+func (r *replier) send(payload interface{}, rerr *RemoteError, eos bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return ErrStreamClosed
+	}
+
+	if err := r.emitter.reply(r.ctx, r.topic, r.seq, eos, payload, rerr); err != nil {
+		return err
+	}
+
+	r.seq++
+	r.closed = eos
+	return nil
+}
+
+// Reply sends an intermediate reply to the requester of the message, the value
+// returned by HandlerFunc is sent as the last reply, closing the reply stream.
+func (m *Message) Reply(v interface{}) error {
+	if m.replier == nil {
+		return ErrReplyToRequired
+	}
+
+	return m.replier.send(v, nil, false)
+}
+
+// RequestStream a RPC like method which implements request/reply pattern where the responder
+// may send multiple replies. The returned channel yields the replies in order and is closed once
+// the last reply was received or ctx is done. Returns an non-nil err if an error occurred while
+// creating or listening to the internal reply topic or encoding the message payload fails or while
+// publishing the message.
+func (e *Emitter) RequestStream(ctx context.Context, topic string, payload interface{}) (<-chan *Message, error) {
+	if len(topic) == 0 {
+		return nil, ErrTopicRequired
+	}
+
+	start := time.Now()
+	in := make(chan *Message)
+	replyTo, listener, err := e.listenReplies(func(ctx context.Context, m *Message) (interface{}, error) {
+		e.metrics.observeRequest(topic, start)
+		select {
+		case in <- m:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := e.encodeMessage(payload, replyTo)
+	if err != nil {
+		listener.Stop()
+		return nil, err
+	}
+
+	if err := e.send(ctx, topic, m, e.publish); err != nil {
+		listener.Stop()
+		return nil, err
+	}
+
+	out := make(chan *Message)
+	go func() {
+		defer listener.Stop()
+		orderReplies(ctx, in, out)
+	}()
+
+	return out, nil
+}
+
+// orderReplies forwards the replies received from in to out following their sequence,
+// buffering the ones arriving out of order. It closes out once the last reply was
+// forwarded or ctx is done.
+func orderReplies(ctx context.Context, in <-chan *Message, out chan<- *Message) {
+	defer close(out)
+
+	next := 0
+	pending := make(map[int]*Message)
+	for {
+		select {
+		case m := <-in:
+			if m.Seq < next {
+				continue
+			}
+			pending[m.Seq] = m
+		case <-ctx.Done():
+			return
+		}
+
+		for {
+			m, ok := pending[next]
+			if !ok {
+				break
+			}
+
+			select {
+			case out <- m:
+			case <-ctx.Done():
+				return
+			}
+
+			delete(pending, next)
+			next++
+			if m.EOS {
+				return
+			}
+		}
+	}
+}
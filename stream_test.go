@@ -0,0 +1,62 @@
+package bus
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestOrderReplies(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	in := make(chan *Message)
+	out := make(chan *Message)
+	go orderReplies(ctx, in, out)
+
+	go func() {
+		for _, m := range []*Message{
+			{Seq: 2, EOS: true},
+			{Seq: 0},
+			{Seq: 0},
+			{Seq: 1},
+		} {
+			in <- m
+		}
+	}()
+
+	var seqs []int
+	for m := range out {
+		seqs = append(seqs, m.Seq)
+	}
+
+	if len(seqs) != 3 || seqs[0] != 0 || seqs[1] != 1 || seqs[2] != 2 {
+		t.Errorf("unexpected replies order %v", seqs)
+	}
+}
+
+func TestOrderRepliesTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	in := make(chan *Message, 1)
+	out := make(chan *Message, 1)
+	in <- &Message{Seq: 1}
+	orderReplies(ctx, in, out)
+
+	if _, ok := <-out; ok {
+		t.Error("expected out of order reply not to be forwarded")
+	}
+}
+
+func TestMessageReply(t *testing.T) {
+	m := NewMessage(nil, "")
+	if err := m.Reply("event"); err != ErrReplyToRequired {
+		t.Fatalf("unexpected error value %v", err)
+	}
+
+	m.replier = &replier{topic: "reply", closed: true}
+	if err := m.Reply("event"); err != ErrStreamClosed {
+		t.Fatalf("unexpected error value %v", err)
+	}
+}
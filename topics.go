@@ -0,0 +1,103 @@
+package bus
+
+import (
+	"path"
+	"time"
+)
+
+// defaultTopicPollInterval is the nsq default LookupdPollInterval used when
+// neither TopicPollInterval nor LookupdPollInterval are configured.
+const defaultTopicPollInterval = time.Minute
+
+// topics returns Topic followed by Topics, skipping empty and repeated topics.
+func (lc ListenerConfig) topics() []string {
+	var topics []string
+	seen := make(map[string]bool)
+	for _, topic := range append([]string{lc.Topic}, lc.Topics...) {
+		if len(topic) != 0 && !seen[topic] {
+			seen[topic] = true
+			topics = append(topics, topic)
+		}
+	}
+
+	return topics
+}
+
+// discovers reports whether the topics are discovered from nsqlookupd.
+func (lc ListenerConfig) discovers() bool {
+	return len(lc.TopicPattern) != 0 || lc.TopicRegexp != nil
+}
+
+// matchTopic reports whether topic matches TopicPattern or TopicRegexp.
+func (lc ListenerConfig) matchTopic(topic string) bool {
+	if len(lc.TopicPattern) != 0 {
+		if ok, _ := path.Match(lc.TopicPattern, topic); ok {
+			return true
+		}
+	}
+
+	return lc.TopicRegexp != nil && lc.TopicRegexp.MatchString(topic)
+}
+
+func (lc ListenerConfig) topicPollInterval() time.Duration {
+	if lc.TopicPollInterval > 0 {
+		return lc.TopicPollInterval
+	}
+
+	if lc.LookupdPollInterval > 0 {
+		return lc.LookupdPollInterval
+	}
+
+	return defaultTopicPollInterval
+}
+
+// pollTopics discovers the topics matching the listener pattern every interval
+// until the listener is stopped.
+func (l *Listener) pollTopics(admin *Admin, interval time.Duration) {
+	defer close(l.discoveryDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.discover(admin); err != nil {
+				l.logger.Error("failed to subscribe to discovered topic", "channel", l.lc.Channel, "error", err)
+			}
+		}
+	}
+}
+
+// discover subscribes to the topics registered in nsqlookupd matching the listener
+// pattern, nsqlookupd being unreachable is logged and retried on the next poll.
+func (l *Listener) discover(admin *Admin) error {
+	topics, err := admin.Topics()
+	if err != nil {
+		l.logger.Warn("failed to discover topics", "channel", l.lc.Channel, "error", err)
+		return nil
+	}
+
+	for _, topic := range topics {
+		if !l.lc.matchTopic(topic) || l.subscribed(topic) {
+			continue
+		}
+
+		if err := l.subscribe(topic); err != nil {
+			return err
+		}
+		l.logger.Info("subscribed to discovered topic", "topic", topic, "channel", l.lc.Channel)
+	}
+
+	return nil
+}
+
+func (l *Listener) subscribed(topic string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok := l.subscriptions[topic]
+	return ok
+}
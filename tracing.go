@@ -0,0 +1,82 @@
+package bus
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/rafaeljesus/nsq-event-bus"
+
+// propagator carries W3C trace context and baggage in Message.Headers.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+func newTracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+
+	return tp.Tracer(tracerName)
+}
+
+// startProducerSpan starts a producer span for publishing m to topic and
+// injects its trace context into m.Headers.
+func startProducerSpan(ctx context.Context, tracer trace.Tracer, topic string, m *Message) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, topic+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nsq"),
+			attribute.String("messaging.operation", "publish"),
+			attribute.String("messaging.destination.name", topic),
+		),
+	)
+
+	InjectTraceContext(ctx, m)
+	return ctx, span
+}
+
+// InjectTraceContext writes the trace context carried by ctx into m.Headers, for messages
+// encoded ahead of time and published later, e.g. by the outbox Relay.
+func InjectTraceContext(ctx context.Context, m *Message) {
+	if m.Headers == nil {
+		m.Headers = make(map[string]string)
+	}
+	propagator.Inject(ctx, propagation.MapCarrier(m.Headers))
+}
+
+// startConsumerSpan starts a consumer span for processing m, child of the
+// producer span whose trace context is carried in m.Headers.
+func startConsumerSpan(ctx context.Context, tracer trace.Tracer, topic, channel string, m *Message) (context.Context, trace.Span) {
+	ctx = propagator.Extract(ctx, propagation.MapCarrier(m.Headers))
+
+	attrs := []attribute.KeyValue{
+		attribute.String("messaging.system", "nsq"),
+		attribute.String("messaging.operation", "process"),
+		attribute.String("messaging.destination.name", topic),
+		attribute.String("messaging.nsq.channel", channel),
+	}
+	if m.Message != nil {
+		attrs = append(attrs,
+			attribute.String("messaging.message.id", string(m.ID[:])),
+			attribute.Int("messaging.nsq.attempts", int(m.Attempts)),
+		)
+	}
+
+	return tracer.Start(ctx, topic+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
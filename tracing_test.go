@@ -0,0 +1,153 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		scenario string
+		function func(*testing.T)
+	}{
+		{
+			"producer span",
+			testTracingProducer,
+		},
+		{
+			"request span parent",
+			testTracingRequestParent,
+		},
+		{
+			"consumer span",
+			testTracingConsumer,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			test.function(t)
+		})
+	}
+}
+
+func testTracingProducer(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	emitter, err := NewEmitter(EmitterConfig{Address: "127.0.0.1:1", TracerProvider: tp})
+	if err != nil {
+		t.Fatalf("expected to initialize emitter %v", err)
+	}
+	defer emitter.Stop()
+
+	m := NewMessage([]byte(`"event"`), "")
+	if err := emitter.send(context.Background(), "orders", m, emitter.publish); err == nil {
+		t.Fatal("expected publish to fail without nsqd")
+	}
+
+	if m.Headers["traceparent"] == "" {
+		t.Errorf("expected trace context to be injected %v", m.Headers)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("unexpected spans %+v", spans)
+	}
+
+	if spans[0].Name != "orders publish" || spans[0].SpanKind != trace.SpanKindProducer || len(spans[0].Events) != 1 {
+		t.Errorf("unexpected producer span %+v", spans[0])
+	}
+}
+
+func testTracingRequestParent(t *testing.T) {
+	nsqd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer nsqd.Close()
+
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer lookupd.Close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	emitter, err := NewEmitter(EmitterConfig{
+		Address:        "127.0.0.1:1",
+		Admin:          NewAdmin(AdminConfig{Address: serverAddress(nsqd)}),
+		Lookup:         []string{serverAddress(lookupd)},
+		TracerProvider: tp,
+		LogLevel:       LogError,
+		Logger:         &loggerMock{},
+	})
+	if err != nil {
+		t.Fatalf("expected to initialize emitter %v", err)
+	}
+	defer emitter.Stop()
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "checkout")
+	handler := func(ctx context.Context, m *Message) (interface{}, error) { return nil, nil }
+	if err := emitter.Request("pricing", "event", handler, WithContext(ctx)); err == nil {
+		t.Fatal("expected request to fail without nsqd")
+	}
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 || spans[0].Name != "pricing publish" {
+		t.Fatalf("unexpected spans %+v", spans)
+	}
+
+	if spans[0].Parent.SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("expected request span to be a child of the context span %+v", spans[0].Parent)
+	}
+}
+
+func testTracingConsumer(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	tracer := newTracer(tp)
+
+	m := NewMessage([]byte(`"event"`), "")
+	_, producer := startProducerSpan(context.Background(), tracer, "orders", m)
+	producer.End()
+
+	h := newHandler(context.Background(), ListenerConfig{
+		Topic:          "orders",
+		Channel:        "billing",
+		TracerProvider: tp,
+		HandlerFunc: func(ctx context.Context, message *Message) (interface{}, error) {
+			if !trace.SpanContextFromContext(ctx).IsValid() {
+				t.Error("expected handler context to carry the consumer span")
+			}
+			return nil, errors.New("failed")
+		},
+	})
+	h.HandleMessage(newNSQMessage(t, m))
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("unexpected spans %+v", spans)
+	}
+
+	consumer := spans[1]
+	if consumer.Name != "orders process" || consumer.SpanKind != trace.SpanKindConsumer {
+		t.Errorf("unexpected consumer span %+v", consumer)
+	}
+
+	if consumer.Parent.SpanID() != spans[0].SpanContext.SpanID() || consumer.SpanContext.TraceID() != spans[0].SpanContext.TraceID() {
+		t.Errorf("expected consumer span to be a child of the producer span %+v", consumer.Parent)
+	}
+
+	if consumer.Status.Description != "failed" {
+		t.Errorf("expected consumer span to record the handler error %+v", consumer.Status)
+	}
+}
@@ -0,0 +1,21 @@
+// Package zaplogger adapts zap loggers to bus.Logger.
+package zaplogger
+
+import (
+	bus "github.com/rafaeljesus/nsq-event-bus"
+	"go.uber.org/zap"
+)
+
+type logger struct {
+	sugar *zap.SugaredLogger
+}
+
+// New returns a bus.Logger logging to l, keyvals are logged as zap fields.
+func New(l *zap.Logger) bus.Logger {
+	return logger{sugar: l.WithOptions(zap.AddCallerSkip(1)).Sugar()}
+}
+
+func (l logger) Debug(msg string, keyvals ...interface{}) { l.sugar.Debugw(msg, keyvals...) }
+func (l logger) Info(msg string, keyvals ...interface{})  { l.sugar.Infow(msg, keyvals...) }
+func (l logger) Warn(msg string, keyvals ...interface{})  { l.sugar.Warnw(msg, keyvals...) }
+func (l logger) Error(msg string, keyvals ...interface{}) { l.sugar.Errorw(msg, keyvals...) }
@@ -0,0 +1,27 @@
+package zaplogger
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogger(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	logger := New(zap.New(core))
+
+	logger.Debug("discarded")
+	logger.Warn("message dead lettered", "topic", "orders", "attempts", 5)
+
+	entries := logs.AllUntimed()
+	if len(entries) != 1 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+
+	fields := entries[0].ContextMap()
+	if entries[0].Level != zapcore.WarnLevel || entries[0].Message != "message dead lettered" || fields["topic"] != "orders" || fields["attempts"] != int64(5) {
+		t.Errorf("unexpected entry %+v", entries[0])
+	}
+}
@@ -0,0 +1,21 @@
+// Package zerologger adapts zerolog loggers to bus.Logger.
+package zerologger
+
+import (
+	bus "github.com/rafaeljesus/nsq-event-bus"
+	"github.com/rs/zerolog"
+)
+
+type logger struct {
+	zl zerolog.Logger
+}
+
+// New returns a bus.Logger logging to l, keyvals are logged as zerolog fields.
+func New(l zerolog.Logger) bus.Logger {
+	return logger{zl: l}
+}
+
+func (l logger) Debug(msg string, keyvals ...interface{}) { l.zl.Debug().Fields(keyvals).Msg(msg) }
+func (l logger) Info(msg string, keyvals ...interface{})  { l.zl.Info().Fields(keyvals).Msg(msg) }
+func (l logger) Warn(msg string, keyvals ...interface{})  { l.zl.Warn().Fields(keyvals).Msg(msg) }
+func (l logger) Error(msg string, keyvals ...interface{}) { l.zl.Error().Fields(keyvals).Msg(msg) }
@@ -0,0 +1,26 @@
+package zerologger
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(zerolog.New(&buf).Level(zerolog.InfoLevel))
+
+	logger.Debug("discarded")
+	logger.Warn("message dead lettered", "topic", "orders", "attempts", 5)
+
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected a single json entry %v: %s", err, buf.String())
+	}
+
+	if entry["level"] != "warn" || entry["message"] != "message dead lettered" || entry["topic"] != "orders" || entry["attempts"] != float64(5) {
+		t.Errorf("unexpected entry %v", entry)
+	}
+}